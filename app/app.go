@@ -52,9 +52,186 @@ func NewApp(handler handler.Handler, printVersion func()) *cli.App {
 						Usage:       "cni configure filename",
 						DefaultText: "/etc/docker/cni.yaml",
 					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "release the networks of removed containers right away, ignoring ip_release_grace",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print what would be released",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "report format, text or json",
+						Value: "text",
+					},
 				},
 				Action: runClean(handler),
 			},
+			{
+				Name:  "recover",
+				Usage: "re-plumb running containers which lost their host side network, e.g. after the host routes are flushed",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+				},
+				Action: runRecover(handler),
+			},
+			{
+				Name:  "gc",
+				Usage: "remove host links and routes with host_veth_prefix left behind by failed ADDs and restores",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print what would be removed",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "report format, text or json",
+						Value: "text",
+					},
+				},
+				Action: runGC(handler),
+			},
+			{
+				Name:  "reconcile",
+				Usage: "fix the drift between the store and the host, e.g. left behind routes and veths",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "run every interval until killed, only once if 0",
+					},
+				},
+				Action: runReconcile(handler),
+			},
+			{
+				Name:  "daemon",
+				Usage: "run as node agent owning the store, serving the hooks and commands on daemon_socket",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+				},
+				Action: runDaemon(handler),
+			},
+			{
+				Name:  "list",
+				Usage: "list the containers and interfaces in the store",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "output format, text or json",
+						Value: "text",
+					},
+				},
+				Action: runList(handler),
+			},
+			{
+				Name:      "inspect",
+				Usage:     "print the stored interfaces, OCI state and CNI results of a container",
+				ArgsUsage: "<container id>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						Usage:       "cni configure filename",
+						DefaultText: "/etc/docker/cni.yaml",
+					},
+				},
+				Action: runInspect(handler),
+			},
+			{
+				Name:  "store",
+				Usage: "manage the store",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "migrate",
+						Usage: "migrate the store to the schema version of this build, which is done when opening it as well",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "config",
+								Usage:       "cni configure filename",
+								DefaultText: "/etc/docker/cni.yaml",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only print the pending migrations",
+							},
+							&cli.StringFlag{
+								Name:  "output",
+								Usage: "report format, text or json",
+								Value: "text",
+							},
+						},
+						Action: runStoreMigrate(handler),
+					},
+					{
+						Name:  "export",
+						Usage: "export all the records, e.g. to carry the IP reservations to another host",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "config",
+								Usage:       "cni configure filename",
+								DefaultText: "/etc/docker/cni.yaml",
+							},
+							&cli.StringFlag{
+								Name:  "file",
+								Usage: "write to file instead of stdout",
+							},
+						},
+						Action: runStoreExport(handler),
+					},
+					{
+						Name:  "import",
+						Usage: "import the records exported by export, validated against this host",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:        "config",
+								Usage:       "cni configure filename",
+								DefaultText: "/etc/docker/cni.yaml",
+							},
+							&cli.StringFlag{
+								Name:  "file",
+								Usage: "read from file instead of stdin",
+							},
+							&cli.StringFlag{
+								Name:  "policy",
+								Usage: "for the records already in the store: skip, overwrite or fail",
+								Value: "fail",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only print what would be imported",
+							},
+							&cli.StringFlag{
+								Name:  "output",
+								Usage: "report format, text or json",
+								Value: "text",
+							},
+						},
+						Action: runStoreImport(handler),
+					},
+				},
+			},
 		},
 	}
 }
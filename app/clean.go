@@ -1,31 +1,80 @@
 package app
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/cni"
 	"github.com/projecteru2/docker-cni/config"
 	"github.com/projecteru2/docker-cni/handler"
+	invFact "github.com/projecteru2/docker-cni/inventory/factory"
 	"github.com/projecteru2/docker-cni/store"
-	"github.com/projecteru2/docker-cni/store/bbolt"
+	storeFact "github.com/projecteru2/docker-cni/store/factory"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
+const (
+	minReleaseBackoff = 30 * time.Second
+	maxReleaseBackoff = time.Hour
+)
+
 var (
 	stor store.Store
 )
 
 func initStore(conf config.Config) error {
 	if stor == nil {
-		stor = bbolt.New(conf)
-		if err := stor.Open(); err != nil {
+		s, err := storeFact.NewStore(conf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = s.Open(); err != nil {
 			return errors.WithStack(err)
 		}
+		stor = s
 	}
 	return nil
 }
 
+// CleanOptions tunes HandleClean.
+type CleanOptions struct {
+	Force  bool `json:"force,omitempty"`   // ignore ip_release_grace and the backoff
+	DryRun bool `json:"dry_run,omitempty"` // only report what would be released
+}
+
+// CleanReport is what clean released, or would release with dry run.
+type CleanReport struct {
+	DryRun     bool                `json:"dry_run"`
+	Containers []*CleanedContainer `json:"containers"`
+}
+
+type CleanedContainer struct {
+	ID         string              `json:"id"`
+	Interfaces []*CleanedInterface `json:"interfaces"`
+	Attempts   int                 `json:"attempts,omitempty"` // DEL attempts so far
+	RetryAt    *time.Time          `json:"retry_at,omitempty"` // set if DEL is backing off
+	Error      string              `json:"error,omitempty"`
+}
+
+type CleanedInterface struct {
+	Network    string   `json:"network,omitempty"`
+	IFName     string   `json:"ifname"`
+	HostIFName string   `json:"host_ifname,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+	IPAMHandle string   `json:"ipam_handle,omitempty"` // calico only, <network>.<container id>
+	Released   bool     `json:"released"`
+	Error      string   `json:"error,omitempty"`
+}
+
 func runClean(handler handler.Handler) func(*cli.Context) error {
 	return func(c *cli.Context) (err error) {
 		defer func() {
@@ -43,53 +92,226 @@ func runClean(handler handler.Handler) func(*cli.Context) error {
 			return errors.WithStack(err)
 		}
 
-		if err := initStore(conf); err != nil {
-			return errors.WithStack(err)
-		}
-		defer stor.Close()
-
 		log.Info("[hook] docker-cni running clean")
-		err = HandleClean(handler, conf)
+		opts := CleanOptions{
+			Force:  c.Bool("force"),
+			DryRun: c.Bool("dry-run"),
+		}
+		var report *CleanReport
+		if err = requestDaemon(conf, http.MethodPost, "/v1/clean", opts, &report); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			report, err = HandleClean(handler, conf, opts)
+		}
+		if report != nil {
+			if e := printCleanReport(os.Stdout, report, c.String("output")); e != nil {
+				return e
+			}
+		}
 		return errors.WithStack(err)
 	}
 }
 
-func HandleClean(handler handler.Handler, conf config.Config) (err error) {
+// HandleClean releases the CNI resources of removed containers, once their
+// reservations expire unless opts.Force is set. The records of a container are
+// kept until DEL succeeds, failures are retried with backoff, which
+// opts.Force skips as well. The report is returned even if some of them fail.
+func HandleClean(handler handler.Handler, conf config.Config, opts CleanOptions) (report *CleanReport, err error) {
 	// Get existing container IDs as a map
-	containerIDs, err := getDockerContainerIDMap()
+	inv, err := invFact.NewInventory(conf)
 	if err != nil {
-		return err
+		return nil, errors.WithStack(err)
+	}
+	containerIDs, err := inv.ContainerIDs()
+	if err != nil {
+		return nil, err
+	}
+	// the records of reserved networks outlive their containers
+	if containerIDs, err = reservedContainerIDs(conf, containerIDs, opts); err != nil {
+		return nil, err
 	}
 
-	deleteMap, err := stor.DeleteContiners(containerIDs)
+	// collect the interfaces of removed containers
+	states, err := stor.ListContainerStates()
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+	report = &CleanReport{DryRun: opts.DryRun, Containers: []*CleanedContainer{}}
+	containers := map[string]*CleanedContainer{}
+	attachments := map[string][]cni.Attachment{}
+	for id, state := range states {
+		if _, exists := containerIDs[id]; exists {
+			continue
+		}
+		infos, err := stor.ListInterfaceInfo(id)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(infos) == 0 {
+			infos = []*store.InterfaceInfo{{IFName: conf.CNIIfname}}
+		}
+		container := &CleanedContainer{ID: id}
+		for _, info := range infos {
+			if err = fillFromCNIResult(info, id); err != nil {
+				log.Warnf("[hook] failed to get CNI result of container %s: %v", id, err)
+			}
+			att := attachmentOf(info)
+			attachments[id] = append(attachments[id], att)
+			container.Interfaces = append(container.Interfaces, &CleanedInterface{
+				Network:    info.Network,
+				IFName:     info.IFName,
+				HostIFName: info.HostIFName,
+				IPs:        info.IPs,
+				IPAMHandle: ipamHandle(handler, conf, &state, att),
+			})
+		}
+		containers[id] = container
+		report.Containers = append(report.Containers, container)
 	}
+	sort.Slice(report.Containers, func(i, j int) bool {
+		return report.Containers[i].ID < report.Containers[j].ID
+	})
+
+	// the containers back in the inventory are not to be released any more
+	releases, err := stor.ListReleases()
+	if err != nil {
+		return report, errors.WithStack(err)
+	}
+	for _, release := range releases {
+		if _, removed := containers[release.ContainerID]; removed || opts.DryRun {
+			continue
+		}
+		if err = stor.DeleteRelease(release.ContainerID); err != nil {
+			return report, errors.WithStack(err)
+		}
+	}
+
+	// the records are dropped only after DEL succeeds, failed ones are retried
+	// by the next run after a backoff
+	now := time.Now()
 	var err2 error
-	for id, state := range deleteMap {
-		log.Infof("[hook] cleaning up CNI resource for container %s", id)
-		if _, err = runCNICommand(handler, conf, &state, "del"); err != nil {
-			log.Errorf("[hook] failed to clean up container %s's CNI resources: %v", id, err)
+	for _, container := range report.Containers {
+		id, state := container.ID, states[container.ID]
+		release, err := stor.GetRelease(id)
+		if err != nil {
+			return report, errors.WithStack(err)
+		}
+		if release == nil {
+			release = &store.Release{ContainerID: id}
+		}
+		container.Attempts = release.Attempts
+		if !opts.Force && now.Before(release.NextAttempt) {
+			container.RetryAt = &release.NextAttempt
+			continue
+		}
+		if opts.DryRun {
+			continue
+		}
+
+		// mark it releasing ahead, in case we don't make it to the end
+		release.Attempts++
+		release.LastAttempt = now
+		if err = stor.PutRelease(release); err != nil {
+			return report, errors.WithStack(err)
+		}
+		container.Attempts = release.Attempts
+
+		log.Infof("[hook] cleaning up CNI resource for container %s, attempt %d", id, release.Attempts)
+		atts := attachments[id]
+		var delErr error
+		// tear down in the reverse order of ADD
+		for i := len(atts) - 1; i >= 0; i-- {
+			prevResult, err := stor.GetCNIResult(id, atts[i].IfName)
+			if err != nil {
+				log.Warnf("[hook] failed to get CNI result of container %s: %v", id, err)
+			}
+			if _, err = runCNICommand(handler, conf, &state, "del", atts[i], prevResult); err != nil {
+				log.Errorf("[hook] failed to clean up container %s's CNI resources of %s: %v", id, atts[i].IfName, err)
+				container.Interfaces[i].Error = err.Error()
+				delErr = err
+				continue
+			}
+			container.Interfaces[i].Released = true
+		}
+		if delErr == nil {
+			if err = stor.DeleteContainer(id); err != nil {
+				log.Errorf("[hook] failed to delete records of container %s: %v", id, err)
+				container.Error = err.Error()
+				err2 = err
+			}
+			continue
+		}
+
+		err2 = delErr
+		release.LastError = delErr.Error()
+		release.NextAttempt = now.Add(releaseBackoff(release.Attempts))
+		container.RetryAt = &release.NextAttempt
+		if err = stor.PutRelease(release); err != nil {
+			log.Errorf("[hook] failed to store release of container %s: %v", id, err)
 			err2 = err
 		}
 	}
 
-	return err2
+	return report, err2
+}
+
+// releaseBackoff doubles from minReleaseBackoff up to maxReleaseBackoff.
+func releaseBackoff(attempts int) time.Duration {
+	backoff := minReleaseBackoff
+	for i := 1; i < attempts && backoff < maxReleaseBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxReleaseBackoff {
+		backoff = maxReleaseBackoff
+	}
+	return backoff
 }
 
-func getDockerContainerIDMap() (map[string]struct{}, error) {
-	containerPath := "/var/lib/docker/containers"
-	files, err := os.ReadDir(containerPath)
+// ipamHandle is the handle calico allocates the IPs with, empty for the other
+// plugins. It's best effort, only for the report.
+func ipamHandle(handler handler.Handler, conf config.Config, state *specs.State, att cni.Attachment) string {
+	config := cniToolConfig(handler, conf, state, "", att, nil)
+	if pluginType, err := cni.PluginType(config); err != nil || pluginType != "calico" {
+		return ""
+	}
+	netName, err := cni.NetworkName(config)
 	if err != nil {
-		return nil, err
+		return ""
 	}
+	return netName + "." + state.ID
+}
 
-	// Using empty struct{} as value since we only care about existence
-	containerIDs := make(map[string]struct{})
-	for _, f := range files {
-		if f.IsDir() {
-			containerIDs[f.Name()] = struct{}{}
+func printCleanReport(w io.Writer, report *CleanReport, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(report))
+	case "", "text":
+	default:
+		return errors.Errorf("unknown output format %q", output)
+	}
+	for _, container := range report.Containers {
+		for _, iface := range container.Interfaces {
+			status := "released"
+			switch {
+			case container.RetryAt != nil && iface.Error == "":
+				status = "retry at " + container.RetryAt.Format(time.RFC3339)
+			case report.DryRun:
+				status = "would release"
+			case iface.Error != "":
+				status = "failed: " + iface.Error
+			case !iface.Released:
+				status = "skipped"
+			}
+			fmt.Fprintf(w, "%s\t%s\tnetwork=%s\tips=%s\thost_ifname=%s\tipam_handle=%s\t%s\n",
+				container.ID, iface.IFName, iface.Network, strings.Join(iface.IPs, ","), iface.HostIFName, orDash(iface.IPAMHandle), status)
+		}
+		if container.Error != "" {
+			fmt.Fprintf(w, "%s\tfailed: %s\n", container.ID, container.Error)
 		}
 	}
-	return containerIDs, nil
+	return nil
 }
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	cnihandler "github.com/projecteru2/docker-cni/handler/cni"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupClean makes net1 a network of a fake plugin, which logs the commands
+// it runs and fails while the fail file exists. No container is alive, and
+// c1 is recorded on net1.
+func setupClean(t *testing.T) (conf config.Config, fail, calls string) {
+	conf = setupTestStore(t)
+	dir := t.TempDir()
+	conf.CNIBinDir = filepath.Join(dir, "bin")
+	conf.Inventory, conf.DockerDataRoot = "data_root", filepath.Join(dir, "docker")
+	fail, calls = filepath.Join(dir, "fail"), filepath.Join(dir, "calls")
+	require.NoError(t, os.MkdirAll(filepath.Join(conf.DockerDataRoot, "containers"), 0755))
+	require.NoError(t, os.MkdirAll(conf.CNIBinDir, 0755))
+	plugin := `#!/bin/sh
+echo "$CNI_COMMAND $CNI_CONTAINERID $CNI_IFNAME" >> ` + calls + `
+if [ -e ` + fail + ` ]; then
+	echo '{"cniVersion":"0.4.0","code":11,"msg":"boom"}'
+	exit 1
+fi
+`
+	require.NoError(t, os.WriteFile(filepath.Join(conf.CNIBinDir, "fake"), []byte(plugin), 0755))
+	netconf := `{"cniVersion":"0.4.0","name":"net1","plugins":[{"type":"fake"}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(conf.CNIConfDir, "10-net1.conflist"), []byte(netconf), 0644))
+
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1", Status: "stopped"}))
+	require.NoError(t, stor.PutInterfaceInfo("c1", &store.InterfaceInfo{Network: "net1", IFName: "eth0", IPs: []string{"10.0.0.1/32"}}))
+	return conf, fail, calls
+}
+
+func countCalls(t *testing.T, calls string) int {
+	data, err := os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+	return strings.Count(string(data), "DEL c1 eth0\n")
+}
+
+func TestReleaseBackoff(t *testing.T) {
+	assert.Equal(t, minReleaseBackoff, releaseBackoff(0))
+	assert.Equal(t, minReleaseBackoff, releaseBackoff(1))
+	assert.Equal(t, 2*minReleaseBackoff, releaseBackoff(2))
+	assert.Equal(t, 4*minReleaseBackoff, releaseBackoff(3))
+	assert.Equal(t, maxReleaseBackoff, releaseBackoff(10))
+	assert.Equal(t, maxReleaseBackoff, releaseBackoff(1000))
+}
+
+func TestHandleClean(t *testing.T) {
+	conf, fail, calls := setupClean(t)
+	handler := &cnihandler.CNIHandler{}
+	require.NoError(t, os.WriteFile(fail, nil, 0600))
+
+	// DEL fails, the records are kept and marked
+	start := time.Now()
+	report, err := HandleClean(handler, conf, CleanOptions{})
+	assert.ErrorContains(t, err, "boom")
+	require.Len(t, report.Containers, 1)
+	container := report.Containers[0]
+	assert.Equal(t, 1, container.Attempts)
+	require.NotNil(t, container.RetryAt)
+	assert.False(t, container.Interfaces[0].Released)
+	assert.Contains(t, container.Interfaces[0].Error, "boom")
+	assert.Equal(t, 1, countCalls(t, calls))
+
+	release, err := stor.GetRelease("c1")
+	require.NoError(t, err)
+	require.NotNil(t, release)
+	assert.Equal(t, 1, release.Attempts)
+	assert.Contains(t, release.LastError, "boom")
+	assert.WithinDuration(t, start.Add(minReleaseBackoff), release.NextAttempt, time.Second)
+	assert.Len(t, storedIPs(t, "c1"), 1)
+
+	// backing off
+	report, err = HandleClean(handler, conf, CleanOptions{})
+	assert.NoError(t, err)
+	require.Len(t, report.Containers, 1)
+	assert.Equal(t, 1, report.Containers[0].Attempts)
+	assert.NotNil(t, report.Containers[0].RetryAt)
+	assert.Equal(t, 1, countCalls(t, calls))
+
+	// force skips the backoff, which grows with the attempts
+	start = time.Now()
+	_, err = HandleClean(handler, conf, CleanOptions{Force: true})
+	assert.Error(t, err)
+	assert.Equal(t, 2, countCalls(t, calls))
+	release, err = stor.GetRelease("c1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, release.Attempts)
+	assert.WithinDuration(t, start.Add(2*minReleaseBackoff), release.NextAttempt, time.Second)
+
+	// dry run doesn't DEL
+	report, err = HandleClean(handler, conf, CleanOptions{Force: true, DryRun: true})
+	assert.NoError(t, err)
+	require.Len(t, report.Containers, 1)
+	assert.Equal(t, 2, countCalls(t, calls))
+
+	// DEL succeeds, the records are dropped along with the release
+	require.NoError(t, os.Remove(fail))
+	report, err = HandleClean(handler, conf, CleanOptions{Force: true})
+	require.NoError(t, err)
+	require.Len(t, report.Containers, 1)
+	assert.Equal(t, 3, report.Containers[0].Attempts)
+	assert.True(t, report.Containers[0].Interfaces[0].Released)
+	assert.Equal(t, 3, countCalls(t, calls))
+	state, err := stor.GetContainerState("c1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+	release, err = stor.GetRelease("c1")
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+
+	report, err = HandleClean(handler, conf, CleanOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Containers)
+}
+
+func TestHandleCleanKeepsAlive(t *testing.T) {
+	conf, _, calls := setupClean(t)
+	require.NoError(t, os.Mkdir(filepath.Join(conf.DockerDataRoot, "containers", "c1"), 0755))
+
+	report, err := HandleClean(&cnihandler.CNIHandler{}, conf, CleanOptions{Force: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.Containers)
+	assert.Zero(t, countCalls(t, calls))
+	assert.Len(t, storedIPs(t, "c1"), 1)
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+)
+
+// daemonResponse is the body of every daemon API response.
+type daemonResponse struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// daemonUnavailableError means the request never reached the daemon, so it's
+// safe to run in-process instead.
+type daemonUnavailableError struct {
+	err error
+}
+
+func (e daemonUnavailableError) Error() string {
+	return "daemon unavailable: " + e.err.Error()
+}
+
+func isDaemonUnavailable(err error) bool {
+	var e daemonUnavailableError
+	return errors.As(err, &e)
+}
+
+// requestDaemon calls the daemon API, out is filled with the data of the
+// response even if the daemon returns an error. The request is abandoned after
+// daemon_timeout, it's not run in-process then since the daemon may be on it.
+func requestDaemon(conf config.Config, method, path string, in, out interface{}) error {
+	if conf.DaemonSocket == "" {
+		return daemonUnavailableError{errors.New("daemon_socket is not set")}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest(method, "http://docker-cni"+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client := &http.Client{
+		Timeout: conf.DaemonTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, "unix", conf.DaemonSocket)
+				if err != nil {
+					return nil, daemonUnavailableError{err}
+				}
+				return conn, nil
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var r daemonResponse
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return errors.Wrapf(err, "invalid response of %s %s, status %d", method, path, resp.StatusCode)
+	}
+	if len(r.Data) != 0 && out != nil {
+		if err = json.Unmarshal(r.Data, out); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if r.Error != "" {
+		return errors.Errorf("daemon: %s", r.Error)
+	}
+	return nil
+}
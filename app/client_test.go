@@ -0,0 +1,81 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	cnihandler "github.com/projecteru2/docker-cni/handler/cni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestDaemon(t *testing.T) {
+	conf := setupTestStore(t)
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1"}))
+	conf.DaemonSocket = filepath.Join(t.TempDir(), "docker-cni.sock")
+	l, err := net.Listen("unix", conf.DaemonSocket)
+	require.NoError(t, err)
+	server := &http.Server{Handler: newDaemonHandler(&cnihandler.CNIHandler{}, conf)}
+	go server.Serve(l)
+	defer server.Close()
+
+	records := []*ContainerRecord{}
+	require.NoError(t, requestDaemon(conf, http.MethodGet, "/v1/containers", nil, &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "c1", records[0].ID)
+
+	// the daemon is up, its errors are not to be run in-process again
+	err = requestDaemon(conf, http.MethodPost, "/v1/store/import", importRequest{}, nil)
+	assert.EqualError(t, err, "daemon: dump is required")
+	assert.False(t, isDaemonUnavailable(err))
+}
+
+func TestRequestDaemonUnavailable(t *testing.T) {
+	// not configured
+	err := requestDaemon(config.Config{}, http.MethodGet, "/v1/containers", nil, nil)
+	assert.True(t, isDaemonUnavailable(err))
+
+	// not running
+	conf := config.Config{DaemonSocket: filepath.Join(t.TempDir(), "docker-cni.sock")}
+	err = requestDaemon(conf, http.MethodGet, "/v1/containers", nil, nil)
+	assert.True(t, isDaemonUnavailable(err))
+
+}
+
+func TestCommandFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Config{StoreFile: filepath.Join(dir, "store.db")}
+	require.NoError(t, initStore(conf))
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1"}))
+	stor.Close()
+	stor = nil
+
+	// the daemon is not running
+	file := filepath.Join(dir, "cni.yaml")
+	yaml := fmt.Sprintf("store_file: %s\ndaemon_socket: %s\nlog_driver: file://%s\n",
+		conf.StoreFile, filepath.Join(dir, "docker-cni.sock"), filepath.Join(dir, "docker-cni.log"))
+	require.NoError(t, os.WriteFile(file, []byte(yaml), 0644))
+	out, err := os.Create(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = out
+	err = NewApp(&cnihandler.CNIHandler{}, nil).Run([]string{"docker-cni", "list", "--config", file, "--output", "json"})
+	os.Stdout = stdout
+	out.Close()
+	stor = nil
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(out.Name())
+	require.NoError(t, err)
+	records := []*ContainerRecord{}
+	require.NoError(t, json.Unmarshal(data, &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "c1", records[0].ID)
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -15,7 +17,9 @@ import (
 	"github.com/projecteru2/docker-cni/cni"
 	"github.com/projecteru2/docker-cni/config"
 	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/network"
 	nwFact "github.com/projecteru2/docker-cni/network/factory"
+	"github.com/projecteru2/docker-cni/store"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -36,10 +40,6 @@ func runCNI(handler handler.Handler) func(*cli.Context) error {
 		if err = conf.SetupLog(); err != nil {
 			return errors.WithStack(err)
 		}
-		if err := initStore(conf); err != nil {
-			return errors.WithStack(err)
-		}
-		defer stor.Close()
 
 		stateBuf, err := io.ReadAll(os.Stdin)
 		if err != nil {
@@ -61,106 +61,470 @@ func runCNI(handler handler.Handler) func(*cli.Context) error {
 			return errors.WithStack(err)
 		}
 
-		cmd := c.String("command")
+		req := CNIRequest{
+			Command: c.String("command"),
+			State:   state,
+			Env:     map[string]string{},
+		}
+		for _, key := range cniEnvKeys {
+			if v := os.Getenv(key); v != "" {
+				req.Env[key] = v
+			}
+		}
+		if err = requestDaemon(conf, http.MethodPost, "/v1/cni", req, nil); !isDaemonUnavailable(err) {
+			return err
+		}
+		log.Debugf("[hook] daemon unavailable, running in-process: %v", err)
+
+		if err := initStore(conf); err != nil {
+			return errors.WithStack(err)
+		}
+		defer stor.Close()
+		return HandleCNI(handler, conf, req)
+	}
+}
+
+// CNIRequest is what the hook hands over to HandleCNI, the state from its
+// stdin and the settings from its env.
+type CNIRequest struct {
+	Command string            `json:"command"`
+	State   specs.State       `json:"state"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// cleanInBackground is set by the daemon when its reconcile loop cleans and
+// recovers, fixed_ip ADD leaves them to the loop instead of holding up every
+// container start.
+var cleanInBackground bool
+
+// cniEnvKeys are the env of the hooks passed in CNIRequest.Env.
+var cniEnvKeys = []string{"CNI_NETWORKS", "CNI_NETWORK", "CNI_ARGS", "CNI_CAPABILITY_ARGS"}
 
-		if conf.FixedIP {
-			switch strings.ToUpper(cmd) {
-			case "ADD":
+// HandleCNI runs the command of the hook for the container, either in the
+// hook or in the daemon.
+func HandleCNI(handler handler.Handler, conf config.Config, req CNIRequest) (err error) {
+	cmd, state := req.Command, req.State
+	attachments, err := cni.ResolveAttachments(req.Env["CNI_NETWORKS"], req.Env["CNI_NETWORK"], conf.CNINetwork, conf.CNIIfname)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for i := range attachments {
+		attachments[i].Args = req.Env["CNI_ARGS"]
+	}
+	// capabilities like ips and mac only make sense for one interface, the primary one
+	if capabilityArgs := req.Env["CNI_CAPABILITY_ARGS"]; capabilityArgs != "" {
+		if err = json.Unmarshal([]byte(capabilityArgs), &attachments[0].CapabilityArgs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if conf.FixedIP {
+		switch strings.ToUpper(cmd) {
+		case "ADD":
+			if !cleanInBackground {
 				// trigger CLEAN task. if encounter error, just log it and continue
-				if err = HandleClean(handler, conf); err != nil {
+				if _, err = HandleClean(handler, conf, CleanOptions{}); err != nil {
 					log.Errorf("[hook] failed to clean up: %+v", err)
 				}
-				// in order to implement fixed ip, we don't run DEL command when stop container
-				// so when start container next time, the ADD commnd will do nothing(CNI behavior)
-				// and we need to configure the network manually
-				// 1. store the interface information(container and hsot veth name, ip) in db
-				// 2. when start container, we need create veth pair and configure ip and gateway manually
-				st, err := stor.GetContainerState(state.ID)
-				if err != nil {
-					log.Errorf("[hook] failed to get container state: %+v", err)
-					return errors.WithStack(err)
+				// so are the running containers which lost their host side
+				if err = HandleRecover(handler, conf); err != nil {
+					log.Errorf("[hook] failed to recover: %+v", err)
 				}
+			}
+			bootID, err := currentBootID()
+			if err != nil {
+				return err
+			}
+			// a container inheriting a reserved network acts as its first holder
+			if state.ID, err = claimReservation(conf, &state); err != nil {
+				log.Errorf("[hook] failed to claim reservation: %+v", err)
+				return errors.WithStack(err)
+			}
+			// in order to implement fixed ip, we don't run DEL command when stop container
+			// so when start container next time, the ADD commnd will do nothing(CNI behavior)
+			// and we need to configure the network manually
+			// 1. store the interface information(container and hsot veth name, ip) in db
+			// 2. when start container, we need create veth pair and configure ip and gateway manually
+			st, err := stor.GetContainerState(state.ID)
+			if err != nil {
+				log.Errorf("[hook] failed to get container state: %+v", err)
+				return errors.WithStack(err)
+			}
 
-				nw, err := nwFact.NewNetwork(conf.CNIType)
+			// create a new container
+			if st == nil {
+				infos, results, err := addAttachments(handler, conf, &state, attachments)
 				if err != nil {
-					log.Errorf("[hook] failed to create network object: %v", err)
 					return errors.WithStack(err)
 				}
-
-				// create a new container
-				if st == nil {
-					res, err := runCNICommand(handler, conf, &state, cmd)
-					if err != nil {
-						log.Errorf("[hook] failed to run CNI ADD: %+v", err)
-						return errors.WithStack(err)
-					}
-
-					// Store CNI result
-					var buf bytes.Buffer
-					if err = res.PrintTo(&buf); err != nil {
-						log.Errorf("[hook] failed to marshal CNI result: %+v", err)
-						return errors.WithStack(err)
-					}
-					log.Infof("[hook] CNI ADD result: %s", buf.String())
-					info, err := nw.ExtractNetworkInfo(&conf, &state)
-					if err != nil {
-						log.Errorf("[hook] failed to extract network info: %+v", err)
-						return errors.WithStack(err)
-					}
-					log.Infof("[hook] extracted network info: %+v", info)
-					if err = stor.PutInterfaceInfo(state.ID, info); err != nil {
-						log.Errorf("[hook] failed to store CNI result: %+v", err)
-						return errors.WithStack(err)
+				if err = recordNewContainer(conf, &state, infos, results, bootID); err != nil {
+					// clean can't find the attachments without the records, release them now
+					delAttachments(handler, conf, &state, attachments)
+					if e := stor.DeleteContainer(state.ID); e != nil {
+						log.Errorf("[hook] failed to drop the records of %s: %+v", state.ID, e)
 					}
-
-					if err = stor.PutContainerState(state.ID, &state); err != nil {
-						log.Errorf("[hook] failed to store container state: %+v", err)
-						return errors.WithStack(err)
-					}
-					return nil
+					return err
 				}
+				return nil
+			}
 
-				// start an old container
-				info, err := stor.GetInterfaceInfo(state.ID)
+			// start an old container
+			infos, err := stor.ListInterfaceInfo(state.ID)
+			if err != nil {
+				log.Errorf("[hook] failed to get interface info: %+v", err)
+				return errors.WithStack(err)
+			}
+			if len(infos) != 0 && infos[0].BootID != bootID {
+				log.Infof("[hook] host rebooted since container %s was plumbed, rebuilding its host side", state.ID)
+			}
+			if err = restoreInterfaces(handler, conf, &state, infos, bootID); err != nil {
+				return err
+			}
+			// keep the pid up to date for recover
+			if err = stampPid(&state); err != nil {
+				return err
+			}
+			if err = stor.PutContainerState(state.ID, &state); err != nil {
+				log.Errorf("[hook] failed to store container state: %+v", err)
+				return errors.WithStack(err)
+			}
+			if len(infos) != 0 {
+				result, err := stor.GetCNIResult(state.ID, infos[0].IFName)
 				if err != nil {
-					log.Errorf("[hook] failed to get interface info: %+v", err)
+					log.Errorf("[hook] failed to load CNI result: %+v", err)
 					return errors.WithStack(err)
 				}
-				if err = nw.SimulateCNIAdd(info, &state); err != nil {
-					log.Errorf("[hook] failed to simulate CNI ADD: %+v", err)
+				if err = writeDNSFiles(conf, &state, infos[0].IFName, result); err != nil {
+					log.Errorf("[hook] failed to write dns files: %+v", err)
+					return errors.WithStack(err)
+				}
+			}
+			return nil
+		case "DEL":
+			// for fixed IP, we don't release cni resource when container stopped
+			// the CLEAN task will release the cni resources for removed containers
+			// mark it stopped, so that recover leaves it alone
+			id, err := recordID(state.ID)
+			if err != nil {
+				return err
+			}
+			st, err := stor.GetContainerState(id)
+			if err != nil || st == nil {
+				return errors.WithStack(err)
+			}
+			st.Status = "stopped"
+			return errors.WithStack(stor.PutContainerState(id, st))
+		case "CHECK":
+			// against the stored results of ADD, under the ID the network was added with
+			if state.ID, err = recordID(state.ID); err != nil {
+				return err
+			}
+			for _, att := range attachments {
+				prevResult, err := stor.GetCNIResult(state.ID, att.IfName)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if _, err = runCNICommand(handler, conf, &state, cmd, att, prevResult); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "ADD":
+		var result bytes.Buffer
+		for i, att := range attachments {
+			res, err := runCNICommand(handler, conf, &state, cmd, att, nil)
+			if err != nil {
+				// DEL the failed one as well, as CNI runtimes do
+				delAttachments(handler, conf, &state, attachments[:i+1])
+				return err
+			}
+			if i == 0 {
+				if err = res.PrintTo(&result); err != nil {
+					delAttachments(handler, conf, &state, attachments[:i+1])
 					return errors.WithStack(err)
 				}
-				return nil
-			case "DEL":
-				// for fixed IP, we don't release cni resource when container stopped
-				// we just store the state in db and the CLEAN task will release the cni resources for removed containers
-				// if err = stor.PutContainerState(state.ID, &state); err != nil {
-				// 	return errors.WithStack(err)
-				// }
-				return nil
 			}
 		}
-		_, err = runCNICommand(handler, conf, &state, cmd)
+		if err = writeDNSFiles(conf, &state, attachments[0].IfName, result.Bytes()); err != nil {
+			delAttachments(handler, conf, &state, attachments)
+			return err
+		}
+		return nil
+	case "DEL":
+		return delAttachments(handler, conf, &state, attachments)
+	}
+	for _, att := range attachments {
+		if _, err = runCNICommand(handler, conf, &state, cmd, att, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordNewContainer stores the records of a container just added, and
+// renders its dns files.
+func recordNewContainer(conf config.Config, state *specs.State, infos []*store.InterfaceInfo, results [][]byte, bootID string) error {
+	for i, info := range infos {
+		info.BootID, info.AddedAt = bootID, time.Now()
+		if err := stor.PutCNIResult(state.ID, info.IFName, results[i]); err != nil {
+			log.Errorf("[hook] failed to store CNI result: %+v", err)
+			return errors.WithStack(err)
+		}
+		if err := stor.PutInterfaceInfo(state.ID, info); err != nil {
+			log.Errorf("[hook] failed to store interface info: %+v", err)
+			return errors.WithStack(err)
+		}
+	}
+	if err := stampPid(state); err != nil {
 		return err
 	}
+	if err := stor.PutContainerState(state.ID, state); err != nil {
+		log.Errorf("[hook] failed to store container state: %+v", err)
+		return errors.WithStack(err)
+	}
+	if err := writeDNSFiles(conf, state, infos[0].IFName, results[0]); err != nil {
+		log.Errorf("[hook] failed to write dns files: %+v", err)
+		return errors.WithStack(err)
+	}
+	return nil
 }
 
-func runCNICommand(handler handler.Handler, conf config.Config, state *specs.State, cmd string) (res types.Result, err error) {
-	netns := ""
-	if state.Pid != 0 {
-		netns = fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+// restoreInterfaces rebuilds the stored interfaces of an old container. The
+// ones restored so far are dropped along with their port mappings if a later
+// one fails, so that the container fails to start without half of its
+// network. The infos are stored only once all of them are restored.
+func restoreInterfaces(handler handler.Handler, conf config.Config, state *specs.State, infos []*store.InterfaceInfo, bootID string) (err error) {
+	restored := []*store.InterfaceInfo{}
+	published := map[string]bool{}
+	stored := []store.InterfaceInfo{} // as they were before stored
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(stored) - 1; i >= 0; i-- {
+			if putErr := stor.PutInterfaceInfo(state.ID, &stored[i]); putErr != nil {
+				log.Errorf("[hook] failed to roll back interface info of %s: %+v", stored[i].IFName, putErr)
+			}
+		}
+		for i := len(restored) - 1; i >= 0; i-- {
+			info := restored[i]
+			if published[info.IFName] {
+				if delErr := replayPortMappings(handler, conf, state, info, "del"); delErr != nil {
+					log.Errorf("[hook] failed to roll back ports of %s: %+v", info.IFName, delErr)
+				}
+			}
+			if delErr := network.DeleteLink(netnsPath(state), info.IFName); delErr != nil {
+				log.Errorf("[hook] failed to roll back %s: %+v", info.IFName, delErr)
+			}
+		}
+	}()
+
+	for _, info := range infos {
+		nw, err := newNetwork(conf, info.Type)
+		if err != nil {
+			log.Errorf("[hook] failed to create network object: %v", err)
+			return errors.WithStack(err)
+		}
+		if err = fillFromCNIResult(info, state.ID); err != nil {
+			log.Errorf("[hook] failed to load CNI result: %+v", err)
+			return errors.WithStack(err)
+		}
+		if err = nw.SimulateCNIAdd(info, state); err != nil {
+			log.Errorf("[hook] failed to simulate CNI ADD for %s: %+v", info.IFName, err)
+			return errors.WithStack(err)
+		}
+		restored = append(restored, info)
+		// a failed replay may have published some of the ports
+		published[info.IFName] = true
+		if err = replayPortMappings(handler, conf, state, info, "add"); err != nil {
+			log.Errorf("[hook] failed to publish ports of %s: %+v", info.IFName, err)
+			return errors.WithStack(err)
+		}
 	}
-	cniToolConfig := cni.CNIToolConfig{
-		CNIPath:     conf.CNIBinDir,
-		NetConfPath: conf.CNIConfDir,
-		NetNS:       netns,
-		Args:        os.Getenv("CNI_ARGS"),
-		IfName:      conf.CNIIfname,
-		Cmd:         cmd,
-		ContainerID: state.ID,
-		Handler:     handler.HandleCNIConfig,
+
+	addedAt := time.Now()
+	for _, info := range infos {
+		old := *info
+		info.BootID, info.AddedAt = bootID, addedAt
+		if err = stor.PutInterfaceInfo(state.ID, info); err != nil {
+			log.Errorf("[hook] failed to store interface info: %+v", err)
+			return errors.WithStack(err)
+		}
+		stored = append(stored, old)
 	}
+	return nil
+}
+
+// addAttachments runs ADD for every attachment in order, and extracts the
+// network info to restore them later. If any of them fails, the attempted ones
+// are deleted.
+func addAttachments(handler handler.Handler, conf config.Config, state *specs.State, attachments []cni.Attachment) (infos []*store.InterfaceInfo, results [][]byte, err error) {
+	attempted := 0
+	defer func() {
+		if err != nil {
+			delAttachments(handler, conf, state, attachments[:attempted])
+		}
+	}()
+
+	for i, att := range attachments {
+		attempted = i + 1
+		res, err := runCNICommand(handler, conf, state, "add", att, nil)
+		if err != nil {
+			log.Errorf("[hook] failed to run CNI ADD for %s: %+v", att.IfName, err)
+			return infos, results, err
+		}
+
+		var buf bytes.Buffer
+		if err = res.PrintTo(&buf); err != nil {
+			log.Errorf("[hook] failed to marshal CNI result: %+v", err)
+			return infos, results, errors.WithStack(err)
+		}
+		log.Infof("[hook] CNI ADD result of %s: %s", att.IfName, buf.String())
+		results = append(results, buf.Bytes())
+
+		nwType := networkType(handler, conf, att)
+		nw, err := newNetwork(conf, nwType)
+		if err != nil {
+			log.Errorf("[hook] failed to create network object: %v", err)
+			return infos, results, errors.WithStack(err)
+		}
+		attConf := conf
+		attConf.CNIIfname = att.IfName
+		info, err := nw.ExtractNetworkInfo(&attConf, state)
+		if err != nil {
+			log.Errorf("[hook] failed to extract network info: %+v", err)
+			return infos, results, errors.WithStack(err)
+		}
+		info.Network, info.Type = att.Network, nwType
+		if info.PortMappings, err = portMappingsOf(att.CapabilityArgs); err != nil {
+			return infos, results, err
+		}
+		log.Infof("[hook] extracted network info: %+v", info)
+		infos = append(infos, info)
+	}
+	return infos, results, nil
+}
+
+// delAttachments runs DEL for every attachment in reverse order, it doesn't stop on failures.
+func delAttachments(handler handler.Handler, conf config.Config, state *specs.State, attachments []cni.Attachment) (err error) {
+	for i := len(attachments) - 1; i >= 0; i-- {
+		if _, e := runCNICommand(handler, conf, state, "del", attachments[i], nil); e != nil {
+			log.Errorf("[hook] failed to run CNI DEL for %s: %+v", attachments[i].IfName, e)
+			err = e
+		}
+	}
+	return err
+}
+
+// networkType decides how the interface of att is restored: cni_type for the
+// default network, otherwise the type of its main plugin if supported.
+func networkType(handler handler.Handler, conf config.Config, att cni.Attachment) string {
+	if att.Network == "" || att.Network == conf.CNINetwork {
+		return conf.CNIType
+	}
+	pluginType, err := cni.PluginType(cniToolConfig(handler, conf, nil, "", att, nil))
+	if err != nil {
+		log.Warnf("[hook] failed to get plugin type of network %s: %v", att.Network, err)
+		return "generic"
+	}
+	if _, err = nwFact.NewNetwork(pluginType); err != nil {
+		return "generic"
+	}
+	return pluginType
+}
+
+func newNetwork(conf config.Config, nwType string) (network.Network, error) {
+	if nwType == "" {
+		nwType = conf.CNIType
+	}
+	return nwFact.NewNetwork(nwType)
+}
+
+// portMappingsOf picks the port mappings out of the capability args, so they can
+// be published again on restore and unpublished on clean.
+func portMappingsOf(capabilityArgs map[string]interface{}) ([]store.PortMapping, error) {
+	v, ok := capabilityArgs["portMappings"]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	portMappings := []store.PortMapping{}
+	return portMappings, errors.WithStack(json.Unmarshal(data, &portMappings))
+}
+
+// attachmentOf rebuilds the attachment of a stored interface, along with the
+// capability args required to tear it down.
+func attachmentOf(info *store.InterfaceInfo) cni.Attachment {
+	att := cni.Attachment{Network: info.Network, IfName: info.IFName}
+	if len(info.PortMappings) != 0 {
+		att.CapabilityArgs = map[string]interface{}{"portMappings": info.PortMappings}
+	}
+	return att
+}
+
+// replayPortMappings runs the portmap plugin again for the restored interface,
+// the rules are gone if the host rebooted since ADD. DEL takes them down.
+func replayPortMappings(handler handler.Handler, conf config.Config, state *specs.State, info *store.InterfaceInfo, cmd string) error {
+	if len(info.PortMappings) == 0 {
+		return nil
+	}
+	prevResult, err := stor.GetCNIResult(state.ID, info.IFName)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if prevResult == nil {
+		return errors.Errorf("no CNI result of %s to publish ports", info.IFName)
+	}
+	config := cniToolConfig(handler, conf, state, cmd, attachmentOf(info), prevResult)
+	return errors.WithStack(cni.ReplayPlugin(config, "portmap"))
+}
+
+// fillFromCNIResult completes the addresses of records which didn't capture
+// them with the stored result of ADD.
+func fillFromCNIResult(info *store.InterfaceInfo, id string) error {
+	if len(info.IPs) != 0 {
+		return nil
+	}
+	raw, err := stor.GetCNIResult(id, info.IFName)
+	if err != nil || raw == nil {
+		return err
+	}
+	info.IPs, err = cni.ResultIPs(raw, info.IFName)
+	return errors.WithStack(err)
+}
+
+func cniToolConfig(handler handler.Handler, conf config.Config, state *specs.State, cmd string, att cni.Attachment, prevResult []byte) cni.CNIToolConfig {
+	netns, containerID := "", ""
+	if state != nil {
+		containerID = state.ID
+		if state.Pid != 0 {
+			netns = fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+		}
+	}
+	return cni.CNIToolConfig{
+		CNIPath:        conf.CNIBinDir,
+		NetConfPath:    conf.CNIConfDir,
+		NetName:        att.Network,
+		NetNS:          netns,
+		Args:           att.Args,
+		CapabilityArgs: att.CapabilityArgs,
+		IfName:         att.IfName,
+		Cmd:            cmd,
+		ContainerID:    containerID,
+		PrevResult:     prevResult,
+		Handler:        handler.HandleCNIConfig,
+	}
+}
 
+func runCNICommand(handler handler.Handler, conf config.Config, state *specs.State, cmd string, att cni.Attachment, prevResult []byte) (res types.Result, err error) {
+	cniToolConfig := cniToolConfig(handler, conf, state, cmd, att, prevResult)
 	log.Infof("[hook] docker-cni running: %+v", cniToolConfig)
 	res, err = cni.Run(cniToolConfig)
 	return res, errors.WithStack(err)
@@ -0,0 +1,204 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// daemonLock serializes the requests and the reconcile loop of the daemon,
+// the reading ones share it.
+var daemonLock sync.RWMutex
+
+func runDaemon(handler handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[daemon] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+		if conf.DaemonSocket == "" {
+			return errors.New("daemon_socket is not set")
+		}
+
+		// same as the hook, the output of CNI plugins goes to cni_log
+		file, err := os.OpenFile(conf.CNILog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := syscall.Dup2(int(file.Fd()), 2); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := initStore(conf); err != nil {
+			return errors.WithStack(err)
+		}
+		defer stor.Close()
+
+		if err = os.MkdirAll(filepath.Dir(conf.DaemonSocket), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = os.Remove(conf.DaemonSocket); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		l, err := net.Listen("unix", conf.DaemonSocket)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = os.Chmod(conf.DaemonSocket, 0600); err != nil {
+			return errors.WithStack(err)
+		}
+
+		server := &http.Server{Handler: newDaemonHandler(handler, conf)}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log.Infof("[daemon] received %v, shutting down", sig)
+			server.Close()
+		}()
+
+		if conf.ReconcileInterval > 0 {
+			cleanInBackground = true
+			go reconcileLoop(handler, conf)
+		}
+
+		log.Infof("[daemon] listening on %s", conf.DaemonSocket)
+		if err = server.Serve(l); err != nil && err != http.ErrServerClosed {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+}
+
+// newDaemonHandler serves the API, requests changing the store are handled one
+// by one, as the hooks did with the lock of the store file. GET requests only
+// read, they run along with each other.
+func newDaemonHandler(handler handler.Handler, conf config.Config) http.Handler {
+	serialize := func(method string, f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+		lock, unlock := daemonLock.Lock, daemonLock.Unlock
+		if method == http.MethodGet {
+			lock, unlock = daemonLock.RLock, daemonLock.RUnlock
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				writeDaemonResponse(w, http.StatusMethodNotAllowed, nil, errors.Errorf("%s only", method))
+				return
+			}
+			lock()
+			data, err := f(r)
+			unlock()
+			if err != nil {
+				log.Errorf("[daemon] failed to handle %s %s: %+v", r.Method, r.URL.Path, err)
+				writeDaemonResponse(w, http.StatusInternalServerError, data, err)
+				return
+			}
+			writeDaemonResponse(w, http.StatusOK, data, nil)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/cni", serialize(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		req := CNIRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		log.Infof("[daemon] running %s for container %s", req.Command, req.State.ID)
+		return nil, HandleCNI(handler, conf, req)
+	}))
+	mux.HandleFunc("/v1/containers", serialize(http.MethodGet, func(_ *http.Request) (interface{}, error) {
+		return listContainerRecords(conf)
+	}))
+	mux.HandleFunc("/v1/containers/{id}", serialize(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return inspectContainer(conf, r.PathValue("id"))
+	}))
+	mux.HandleFunc("/v1/store/export", serialize(http.MethodGet, func(_ *http.Request) (interface{}, error) {
+		return store.Export(stor)
+	}))
+	mux.HandleFunc("/v1/store/import", serialize(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		req := importRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if req.Dump == nil {
+			return nil, errors.New("dump is required")
+		}
+		return HandleImport(handler, conf, req.Dump, req.ImportOptions)
+	}))
+	mux.HandleFunc("/v1/clean", serialize(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		opts := CleanOptions{}
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return HandleClean(handler, conf, opts)
+	}))
+	mux.HandleFunc("/v1/recover", serialize(http.MethodPost, func(_ *http.Request) (interface{}, error) {
+		return nil, HandleRecover(handler, conf)
+	}))
+	mux.HandleFunc("/v1/gc", serialize(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		opts := struct {
+			DryRun bool `json:"dry_run"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return HandleGC(conf, opts.DryRun)
+	}))
+	mux.HandleFunc("/v1/reconcile", serialize(http.MethodPost, func(_ *http.Request) (interface{}, error) {
+		return nil, HandleReconcile(handler, conf)
+	}))
+	return mux
+}
+
+func reconcileLoop(handler handler.Handler, conf config.Config) {
+	ticker := time.NewTicker(conf.ReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		daemonLock.Lock()
+		if err := HandleReconcile(handler, conf); err != nil {
+			log.Errorf("[daemon] failed to reconcile: %+v", err)
+		}
+		daemonLock.Unlock()
+	}
+}
+
+func writeDaemonResponse(w http.ResponseWriter, status int, data interface{}, err error) {
+	resp := daemonResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if data != nil {
+		buf, e := json.Marshal(data)
+		if e != nil {
+			status, resp.Error = http.StatusInternalServerError, e.Error()
+		}
+		resp.Data = buf
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warnf("[daemon] failed to write response: %v", err)
+	}
+}
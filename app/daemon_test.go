@@ -0,0 +1,69 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	cnihandler "github.com/projecteru2/docker-cni/handler/cni"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonHandler(t *testing.T) {
+	conf := setupTestStore(t)
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1", Status: "running"}))
+	require.NoError(t, stor.PutInterfaceInfo("c1", &store.InterfaceInfo{IFName: "eth0", IPs: []string{"10.0.0.1/32"}}))
+	require.NoError(t, stor.PutCNIResult("c1", "eth0", []byte(`{"cniVersion":"0.4.0"}`)))
+	server := httptest.NewServer(newDaemonHandler(&cnihandler.CNIHandler{}, conf))
+	defer server.Close()
+
+	do := func(method, path, body string) (int, daemonResponse) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		r := daemonResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&r))
+		return resp.StatusCode, r
+	}
+
+	status, r := do(http.MethodGet, "/v1/containers", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, r.Error)
+	records := []*ContainerRecord{}
+	require.NoError(t, json.Unmarshal(r.Data, &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "c1", records[0].ID)
+	assert.Equal(t, []string{"10.0.0.1/32"}, records[0].Interfaces[0].IPs)
+
+	status, r = do(http.MethodGet, "/v1/containers/c1", "")
+	assert.Equal(t, http.StatusOK, status)
+	record := &ContainerRecord{}
+	require.NoError(t, json.Unmarshal(r.Data, record))
+	assert.JSONEq(t, `{"cniVersion":"0.4.0"}`, string(record.CNIResults["eth0"]))
+
+	status, r = do(http.MethodGet, "/v1/containers/c2", "")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.NotEmpty(t, r.Error)
+
+	status, r = do(http.MethodPost, "/v1/containers", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	assert.Equal(t, "GET only", r.Error)
+
+	status, r = do(http.MethodPost, "/v1/store/import", `{"policy":"skip"}`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "dump is required", r.Error)
+
+	status, r = do(http.MethodGet, "/v1/store/export", "")
+	assert.Equal(t, http.StatusOK, status)
+	dump := &store.Dump{}
+	require.NoError(t, json.Unmarshal(r.Data, dump))
+	require.Len(t, dump.Containers, 1)
+	assert.Equal(t, "c1", dump.Containers[0].ID)
+}
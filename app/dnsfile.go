@@ -0,0 +1,81 @@
+package app
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/cni"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/dns"
+	"github.com/projecteru2/docker-cni/oci"
+	log "github.com/sirupsen/logrus"
+)
+
+// writeDNSFiles renders the resolv.conf and hosts bound by oci.BindDNSFiles
+// from the CNI result of the primary interface, the dns_* config wins over the result.
+// Files are written in place, since they are bind mounted already.
+func writeDNSFiles(conf config.Config, state *specs.State, ifname string, result []byte) error {
+	resolvConf := filepath.Join(state.Bundle, oci.ResolvConfFilename)
+	hosts := filepath.Join(state.Bundle, oci.HostsFilename)
+	if _, err := os.Stat(resolvConf); os.IsNotExist(err) {
+		// not bound at creation
+		return nil
+	}
+
+	dnsConf := dns.Config{
+		Nameservers: conf.DNSNameservers,
+		Search:      conf.DNSSearch,
+		Options:     conf.DNSOptions,
+	}
+	if dnsConf.Empty() && result != nil {
+		resultDNS, err := cni.ResultDNS(result)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dnsConf = dns.Config{
+			Nameservers: resultDNS.Nameservers,
+			Domain:      resultDNS.Domain,
+			Search:      resultDNS.Search,
+			Options:     resultDNS.Options,
+		}
+	}
+	if !dnsConf.Empty() {
+		if err := os.WriteFile(resolvConf, dns.RenderResolvConf(dnsConf), 0644); err != nil {
+			return errors.WithStack(err)
+		}
+		log.Infof("[hook] rendered %s: %+v", resolvConf, dnsConf)
+	}
+
+	if result == nil {
+		return nil
+	}
+	cidrs, err := cni.ResultIPs(result, ifname)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ips := []string{}
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ips = append(ips, ip.String())
+	}
+	containerMeta, err := oci.LoadContainerMeta(filepath.Join(state.Bundle, "config.json"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// keep what docker seeded, e.g. --add-host
+	seeded, err := os.ReadFile(hosts)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if err = os.WriteFile(hosts, dns.RenderHosts(seeded, containerMeta.Hostname, ips), 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Infof("[hook] rendered %s: %s %v", hosts, containerMeta.Hostname, ips)
+	return nil
+}
@@ -0,0 +1,430 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/cni"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// conflict policies of import, for the records already in the store
+const (
+	conflictSkip      = "skip"      // keep the stored ones
+	conflictOverwrite = "overwrite" // replace the stored ones
+	conflictFail      = "fail"      // import nothing
+)
+
+// ImportOptions tunes HandleImport.
+type ImportOptions struct {
+	Policy string `json:"policy,omitempty"` // skip, overwrite or fail, fail if empty
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// importRequest is the body of POST /v1/store/import.
+type importRequest struct {
+	ImportOptions
+	Dump *store.Dump `json:"dump"`
+}
+
+// ImportReport is what import wrote, or would write with dry run.
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Policy  string            `json:"policy"`
+	Records []*ImportedRecord `json:"records"`
+}
+
+// ImportedRecord is a container or a reservation of the dump.
+type ImportedRecord struct {
+	Kind   string `json:"kind"`   // container or reservation
+	ID     string `json:"id"`     // container ID or reservation key
+	Action string `json:"action"` // imported, overwritten, skipped, conflict or invalid
+	Error  string `json:"error,omitempty"`
+}
+
+func runStoreExport(_ handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[store] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var dump *store.Dump
+		if err = requestDaemon(conf, http.MethodGet, "/v1/store/export", nil, &dump); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			dump, err = store.Export(stor)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		w := io.Writer(os.Stdout)
+		if file := c.String("file"); file != "" && file != "-" {
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(dump); err != nil {
+			return errors.WithStack(err)
+		}
+		log.Infof("[store] exported %d containers and %d reservations", len(dump.Containers), len(dump.Reservations))
+		return nil
+	}
+}
+
+func runStoreImport(handler handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[store] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		r := io.Reader(os.Stdin)
+		if file := c.String("file"); file != "" && file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		dump := &store.Dump{}
+		if err = json.NewDecoder(r).Decode(dump); err != nil {
+			return errors.Wrap(err, "invalid dump")
+		}
+
+		opts := ImportOptions{
+			Policy: c.String("policy"),
+			DryRun: c.Bool("dry-run"),
+		}
+		var report *ImportReport
+		if err = requestDaemon(conf, http.MethodPost, "/v1/store/import", importRequest{ImportOptions: opts, Dump: dump}, &report); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			report, err = HandleImport(handler, conf, dump, opts)
+		}
+		if report != nil {
+			if e := printImportReport(os.Stdout, report, c.String("output")); e != nil {
+				return e
+			}
+		}
+		return errors.WithStack(err)
+	}
+}
+
+// HandleImport writes the records of dump into the store. The records already
+// in the store are handled by opts.Policy, and the new ones are validated
+// against this host: the networks, parent interfaces and network types must be
+// known, the host veths must not be taken, nor the IPs by other containers.
+// Nothing is written if any record conflicts or is invalid. Stored interfaces
+// are only overwritten by ones with the same network and IPs.
+//
+// The containers are imported as stopped, to be restored when they start on
+// this host, and the grace period of their reservations starts over.
+func HandleImport(handler handler.Handler, conf config.Config, dump *store.Dump, opts ImportOptions) (*ImportReport, error) {
+	switch opts.Policy {
+	case "":
+		opts.Policy = conflictFail
+	case conflictSkip, conflictOverwrite, conflictFail:
+	default:
+		return nil, errors.Errorf("unknown conflict policy %q", opts.Policy)
+	}
+	if err := dump.Validate(); err != nil {
+		return nil, err
+	}
+	report := &ImportReport{DryRun: opts.DryRun, Policy: opts.Policy, Records: []*ImportedRecord{}}
+
+	// IP -> container, of the records staying in the store
+	recordedIPs := map[string]string{}
+	stored := map[string]struct{}{}
+	replaced := map[string][]*store.InterfaceInfo{}
+	err := stor.ForEachContainer(func(id string, _ *specs.State, infos []*store.InterfaceInfo) error {
+		stored[id] = struct{}{}
+		if opts.Policy == conflictOverwrite && dumped(dump, id) {
+			replaced[id] = infos
+			return nil
+		}
+		for _, info := range infos {
+			for _, ip := range info.IPs {
+				if dst := hostRouteDst(ip); dst != nil {
+					recordedIPs[dst.IP.String()] = id
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	failed := 0
+	containers := []*store.DumpedContainer{}
+	for _, container := range dump.Containers {
+		record := &ImportedRecord{Kind: "container", ID: container.ID, Action: "imported"}
+		report.Records = append(report.Records, record)
+		if _, ok := stored[container.ID]; ok {
+			record.Action = conflictAction(opts.Policy)
+		}
+		if record.Action == "skipped" {
+			continue
+		}
+		if record.Action == "overwritten" {
+			if err := checkReplacedIPs(replaced[container.ID], container.Interfaces); err != nil {
+				record.Action, record.Error = "invalid", err.Error()
+			}
+		}
+		if record.Action != "conflict" && record.Action != "invalid" {
+			if err := validateImportedContainer(handler, conf, container, recordedIPs, record.Action == "overwritten"); err != nil {
+				record.Action, record.Error = "invalid", err.Error()
+			}
+		}
+		if record.Action == "conflict" || record.Action == "invalid" {
+			failed++
+			continue
+		}
+		containers = append(containers, container)
+	}
+
+	reservations := []*store.Reservation{}
+	for _, reservation := range dump.Reservations {
+		record := &ImportedRecord{Kind: "reservation", ID: reservation.Key, Action: "imported"}
+		report.Records = append(report.Records, record)
+		existing, err := stor.GetReservation(reservation.Key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if existing != nil {
+			record.Action = conflictAction(opts.Policy)
+		}
+		switch record.Action {
+		case "skipped":
+			continue
+		case "conflict":
+			failed++
+			continue
+		}
+		if _, ok := stored[reservation.ContainerID]; !ok && !dumped(dump, reservation.ContainerID) {
+			record.Action, record.Error = "invalid", fmt.Sprintf("no records of container %s", reservation.ContainerID)
+			failed++
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	if failed != 0 {
+		return report, errors.Errorf("%d records can't be imported, nothing is imported", failed)
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, container := range containers {
+		if err = importContainer(dump, container); err != nil {
+			return report, err
+		}
+	}
+	for _, reservation := range reservations {
+		reservation.ReleasedAt = time.Time{}
+		if err = stor.PutReservation(reservation); err != nil {
+			return report, errors.WithStack(err)
+		}
+	}
+	log.Infof("[store] imported %d containers and %d reservations from %s", len(containers), len(reservations), dump.Host)
+	return report, nil
+}
+
+func conflictAction(policy string) string {
+	switch policy {
+	case conflictSkip:
+		return "skipped"
+	case conflictOverwrite:
+		return "overwritten"
+	}
+	return "conflict"
+}
+
+func dumped(dump *store.Dump, id string) bool {
+	for _, container := range dump.Containers {
+		if container.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// validateImportedContainer checks the container can be restored on this host,
+// the IPs of the container are added to recordedIPs. The host veths may exist
+// if the container is stored already, they belong to the replaced records.
+func validateImportedContainer(handler handler.Handler, conf config.Config, container *store.DumpedContainer, recordedIPs map[string]string, replacing bool) error {
+	for _, info := range container.Interfaces {
+		if _, err := newNetwork(conf, info.Type); err != nil {
+			return errors.Wrapf(err, "%s", info.IFName)
+		}
+		if _, err := cni.NetworkName(cniToolConfig(handler, conf, nil, "", attachmentOf(info), nil)); err != nil {
+			return errors.Wrapf(err, "network of %s", info.IFName)
+		}
+		if info.Parent != "" {
+			parent, err := generic.LookupLink(info.Parent)
+			if err != nil {
+				return err
+			}
+			if parent == nil {
+				return errors.Errorf("parent %s of %s not found", info.Parent, info.IFName)
+			}
+		}
+		if info.HostIFName != "" && !replacing {
+			hostVeth, err := generic.LookupLink(info.HostIFName)
+			if err != nil {
+				return err
+			}
+			if hostVeth != nil {
+				return errors.Errorf("host link %s of %s exists", info.HostIFName, info.IFName)
+			}
+		}
+		for _, ip := range info.IPs {
+			dst := hostRouteDst(ip)
+			if dst == nil {
+				return errors.Errorf("invalid ip %s of %s", ip, info.IFName)
+			}
+			if owner, ok := recordedIPs[dst.IP.String()]; ok && owner != container.ID {
+				return errors.Errorf("ip %s of %s is recorded for container %s", ip, info.IFName, owner)
+			}
+			recordedIPs[dst.IP.String()] = container.ID
+		}
+	}
+	return nil
+}
+
+// checkReplacedIPs refuses to overwrite the stored interfaces with dumped ones
+// of other networks or IPs: the stored records are dropped without CNI DEL, so
+// their IPAM allocations would leak. Clean the container first then.
+func checkReplacedIPs(stored, dumped []*store.InterfaceInfo) error {
+	for _, old := range stored {
+		var info *store.InterfaceInfo
+		for _, i := range dumped {
+			if i.IFName == old.IFName {
+				info = i
+				break
+			}
+		}
+		if info == nil || info.Network != old.Network || !sameIPs(info.IPs, old.IPs) {
+			return errors.Errorf("stored %s differs from the dumped one, clean the container first", old.IFName)
+		}
+	}
+	return nil
+}
+
+func sameIPs(a, b []string) bool {
+	ips := map[string]int{}
+	for _, ip := range a {
+		if dst := hostRouteDst(ip); dst != nil {
+			ips[dst.IP.String()]++
+		}
+	}
+	for _, ip := range b {
+		if dst := hostRouteDst(ip); dst != nil {
+			ips[dst.IP.String()]--
+		}
+	}
+	for _, n := range ips {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// importContainer replaces the records of the container with the dumped ones,
+// along with its release if any.
+func importContainer(dump *store.Dump, container *store.DumpedContainer) error {
+	if err := stor.DeleteContainer(container.ID); err != nil {
+		return errors.WithStack(err)
+	}
+	// the container doesn't run on this host yet, and the processes are gone anyway
+	state := container.State
+	state.Status, state.Pid = "stopped", 0
+	if err := stor.PutContainerState(container.ID, &state); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, info := range container.Interfaces {
+		info.Drift = ""
+		if err := stor.PutInterfaceInfo(container.ID, info); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for ifname, result := range container.CNIResults {
+		if err := stor.PutCNIResult(container.ID, ifname, result); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, release := range dump.Releases {
+		if release.ContainerID == container.ID {
+			if err := stor.PutRelease(release); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+func printImportReport(w io.Writer, report *ImportReport, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(report))
+	case "", "text":
+	default:
+		return errors.Errorf("unknown output format %q", output)
+	}
+	for _, record := range report.Records {
+		action := record.Action
+		if report.DryRun && (action == "imported" || action == "overwritten") {
+			action = "would be " + action
+		}
+		if record.Error != "" {
+			action += ": " + record.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", record.Kind, record.ID, action)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	cnihandler "github.com/projecteru2/docker-cni/handler/cni"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupImport opens a temporary store with c1 recorded on 10.0.0.1, and one
+// CNI network to import into.
+func setupImport(t *testing.T) config.Config {
+	conf := setupTestStore(t)
+	conf.CNIType = "calico"
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1", Status: "running", Pid: 1}))
+	require.NoError(t, stor.PutInterfaceInfo("c1", &store.InterfaceInfo{Network: "net1", IFName: "eth0", IPs: []string{"10.0.0.1/32"}}))
+	return conf
+}
+
+func dumpOf(containers ...*store.DumpedContainer) *store.Dump {
+	return &store.Dump{Version: store.DumpVersion, Containers: containers}
+}
+
+func dumpedContainer(id, ip string) *store.DumpedContainer {
+	return &store.DumpedContainer{
+		ID:         id,
+		State:      specs.State{ID: id, Status: "running", Pid: 42},
+		Interfaces: []*store.InterfaceInfo{{Network: "net1", IFName: "eth0", IPs: []string{ip}}},
+	}
+}
+
+func actionsOf(report *ImportReport) map[string]string {
+	actions := map[string]string{}
+	for _, record := range report.Records {
+		actions[record.ID] = record.Action
+	}
+	return actions
+}
+
+func storedIPs(t *testing.T, id string) []string {
+	infos, err := stor.ListInterfaceInfo(id)
+	require.NoError(t, err)
+	ips := []string{}
+	for _, info := range infos {
+		ips = append(ips, info.IPs...)
+	}
+	return ips
+}
+
+func TestHandleImportFail(t *testing.T) {
+	conf := setupImport(t)
+	dump := dumpOf(dumpedContainer("c1", "10.0.0.1/32"), dumpedContainer("c2", "10.0.0.2/32"))
+
+	report, err := HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{})
+	assert.ErrorContains(t, err, "can't be imported")
+	assert.Equal(t, conflictFail, report.Policy)
+	assert.Equal(t, map[string]string{"c1": "conflict", "c2": "imported"}, actionsOf(report))
+
+	// nothing is written
+	state, err := stor.GetContainerState("c2")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestHandleImportSkip(t *testing.T) {
+	conf := setupImport(t)
+	dump := dumpOf(dumpedContainer("c1", "10.0.0.1/32"), dumpedContainer("c2", "10.0.0.2/32"))
+	dump.Reservations = []*store.Reservation{{Key: "web", ContainerID: "c2", Holder: "c2"}}
+
+	report, err := HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{Policy: conflictSkip})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"c1": "skipped", "c2": "imported", "web": "imported"}, actionsOf(report))
+
+	state, err := stor.GetContainerState("c1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Pid, "the stored one is kept")
+
+	// imported as stopped, to be restored when it starts here
+	state, err = stor.GetContainerState("c2")
+	require.NoError(t, err)
+	assert.Equal(t, "stopped", state.Status)
+	assert.Zero(t, state.Pid)
+	assert.Equal(t, []string{"10.0.0.2/32"}, storedIPs(t, "c2"))
+	reservation, err := stor.GetReservation("web")
+	require.NoError(t, err)
+	assert.Equal(t, "c2", reservation.ContainerID)
+}
+
+func TestHandleImportOverwrite(t *testing.T) {
+	conf := setupImport(t)
+
+	// the IPs of the stored records would leak
+	dump := dumpOf(dumpedContainer("c1", "10.0.0.3/32"))
+	report, err := HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{Policy: conflictOverwrite})
+	assert.ErrorContains(t, err, "can't be imported")
+	assert.Equal(t, map[string]string{"c1": "invalid"}, actionsOf(report))
+	assert.Equal(t, []string{"10.0.0.1/32"}, storedIPs(t, "c1"))
+
+	dump = dumpOf(dumpedContainer("c1", "10.0.0.1"))
+	dump.Containers[0].Interfaces[0].MAC = "ee:ee:ee:ee:ee:ee"
+	report, err = HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{Policy: conflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"c1": "overwritten"}, actionsOf(report))
+	infos, err := stor.ListInterfaceInfo("c1")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "ee:ee:ee:ee:ee:ee", infos[0].MAC)
+}
+
+func TestHandleImportInvalid(t *testing.T) {
+	conf := setupImport(t)
+
+	// the IP is recorded for c1
+	dump := dumpOf(dumpedContainer("c2", "10.0.0.1/24"))
+	report, err := HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{Policy: conflictSkip})
+	assert.ErrorContains(t, err, "can't be imported")
+	assert.Equal(t, map[string]string{"c2": "invalid"}, actionsOf(report))
+
+	// unknown network
+	dump = dumpOf(dumpedContainer("c2", "10.0.0.2/32"))
+	dump.Containers[0].Interfaces[0].Network = "net2"
+	report, err = HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{})
+	assert.ErrorContains(t, err, "can't be imported")
+	assert.Equal(t, map[string]string{"c2": "invalid"}, actionsOf(report))
+
+	// reservation of a container neither stored nor dumped
+	dump = dumpOf()
+	dump.Reservations = []*store.Reservation{{Key: "web", ContainerID: "c3"}}
+	report, err = HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{})
+	assert.ErrorContains(t, err, "can't be imported")
+	assert.Equal(t, map[string]string{"web": "invalid"}, actionsOf(report))
+
+	_, err = HandleImport(&cnihandler.CNIHandler{}, conf, dumpOf(), ImportOptions{Policy: "merge"})
+	assert.ErrorContains(t, err, `unknown conflict policy "merge"`)
+
+	dump = dumpOf(dumpedContainer("c2", "10.0.0.2/32"), dumpedContainer("c2", "10.0.0.3/32"))
+	_, err = HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{})
+	assert.ErrorContains(t, err, "duplicate container c2")
+}
+
+func TestHandleImportDryRun(t *testing.T) {
+	conf := setupImport(t)
+	dump := dumpOf(dumpedContainer("c2", "10.0.0.2/32"))
+
+	report, err := HandleImport(&cnihandler.CNIHandler{}, conf, dump, ImportOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, map[string]string{"c2": "imported"}, actionsOf(report))
+	state, err := stor.GetContainerState("c2")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
@@ -0,0 +1,300 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netlink"
+)
+
+// GCReport is what gc removed, or would remove with dry run.
+type GCReport struct {
+	DryRun bool     `json:"dry_run"`
+	Links  []string `json:"links"`  // host links, <container id>/<link> for the ones in a container netns
+	Routes []string `json:"routes"` // <dst> dev <link>
+}
+
+func runGC(handler handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[gc] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Info("[gc] docker-cni running gc")
+		dryRun := c.Bool("dry-run")
+		var report *GCReport
+		if err = requestDaemon(conf, http.MethodPost, "/v1/gc", map[string]bool{"dry_run": dryRun}, &report); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			report, err = HandleGC(conf, dryRun)
+		}
+		if report != nil {
+			if e := printGCReport(os.Stdout, report, c.String("output")); e != nil {
+				return e
+			}
+		}
+		return errors.WithStack(err)
+	}
+}
+
+// HandleGC removes what failed ADDs and restores leave behind, among the
+// links with host_veth_prefix and their scope link routes, unless they are in
+// gc_allowlist:
+//
+//   - host veths not referenced by any record, whose peer is not in any
+//     container netns either
+//   - links with the prefix stranded in the netns of running containers, i.e.
+//     host veths which never made it back to the host, see withContainerNetns
+//   - host routes through referenced links to IPs not recorded for them
+func HandleGC(conf config.Config, dryRun bool) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun, Links: []string{}, Routes: []string{}}
+	if conf.HostVethPrefix == "" {
+		return report, nil
+	}
+	allowlist, err := parseGCAllowlist(conf.GCAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := listRecordedContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	// host veth name -> recorded IPs
+	referenced := map[string]map[string]struct{}{}
+	for _, container := range containers {
+		for _, info := range container.infos {
+			if info.HostIFName == "" {
+				continue
+			}
+			if referenced[info.HostIFName] == nil {
+				referenced[info.HostIFName] = map[string]struct{}{}
+			}
+			for _, ip := range info.IPs {
+				if dst := hostRouteDst(ip); dst != nil {
+					referenced[info.HostIFName][dst.String()] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var err2 error
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list host links")
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if !strings.HasPrefix(attrs.Name, conf.HostVethPrefix) || allowlist.allowsLink(attrs.Name) {
+			continue
+		}
+		if ips, ok := referenced[attrs.Name]; ok {
+			if err = gcRoutes(link, ips, allowlist, report); err != nil {
+				log.Errorf("[gc] failed to collect routes of %s: %+v", attrs.Name, err)
+				err2 = err
+			}
+			continue
+		}
+		if _, ok := link.(*netlink.Veth); !ok {
+			continue
+		}
+		if attrs.NetNsID >= 0 {
+			// the peer is in some container netns, not ours but alive
+			continue
+		}
+		report.Links = append(report.Links, attrs.Name)
+		if dryRun {
+			continue
+		}
+		log.Infof("[gc] deleting host link %s", attrs.Name)
+		if err = netlink.LinkDel(link); err != nil {
+			log.Errorf("[gc] failed to delete %s: %v", attrs.Name, err)
+			err2 = err
+		}
+	}
+
+	for _, container := range containers {
+		if !container.running {
+			continue
+		}
+		own := map[string]struct{}{}
+		for _, info := range container.infos {
+			own[info.IFName] = struct{}{}
+		}
+		err := withContainerNetns(&container.state, func(_ ns.NetNS) error {
+			links, err := netlink.LinkList()
+			if err != nil {
+				return errors.Wrap(err, "failed to list links")
+			}
+			for _, link := range links {
+				name := link.Attrs().Name
+				if _, ok := own[name]; ok || !strings.HasPrefix(name, conf.HostVethPrefix) || allowlist.allowsLink(name) {
+					continue
+				}
+				report.Links = append(report.Links, container.state.ID+"/"+name)
+				if dryRun {
+					continue
+				}
+				log.Infof("[gc] deleting %s stranded in container %s", name, container.state.ID)
+				if err = netlink.LinkDel(link); err != nil {
+					return errors.Wrapf(err, "failed to delete %s", name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("[gc] failed to collect links of container %s: %+v", container.state.ID, err)
+			err2 = err
+		}
+	}
+	return report, err2
+}
+
+// withContainerNetns runs fn in the netns of the container, it refuses to if
+// the pid no longer belongs to the container or the netns is the host one,
+// e.g. the pid is reused by a host process.
+func withContainerNetns(state *specs.State, fn func(ns.NetNS) error) error {
+	netns, err := ns.GetNS(netnsPath(state))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer netns.Close()
+	// checked after the netns is opened, so it's the one of the container
+	owned, err := ownsPid(state)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return errors.Errorf("pid %d no longer belongs to the container", state.Pid)
+	}
+	hostNetns, err := os.Stat("/proc/self/ns/net")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stat := &syscall.Stat_t{}
+	if err = syscall.Fstat(int(netns.Fd()), stat); err != nil {
+		return errors.WithStack(err)
+	}
+	if host := hostNetns.Sys().(*syscall.Stat_t); stat.Dev == host.Dev && stat.Ino == host.Ino {
+		return errors.Errorf("netns of pid %d is the host one", state.Pid)
+	}
+	return netns.Do(fn)
+}
+
+// gcRoutes deletes the scope link host routes through link to the IPs not in ips.
+func gcRoutes(link netlink.Link, ips map[string]struct{}, allowlist gcAllowlist, report *GCReport) error {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list routes of %s", link.Attrs().Name)
+	}
+	for _, route := range routes {
+		if route.Scope != netlink.SCOPE_LINK || route.Dst == nil {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones != bits {
+			continue
+		}
+		if _, ok := ips[route.Dst.String()]; ok || allowlist.allowsIP(route.Dst.IP) {
+			continue
+		}
+		report.Routes = append(report.Routes, fmt.Sprintf("%s dev %s", route.Dst, link.Attrs().Name))
+		if report.DryRun {
+			continue
+		}
+		log.Infof("[gc] deleting route to %s via %s", route.Dst, link.Attrs().Name)
+		if err = netlink.RouteDel(&route); err != nil {
+			return errors.Wrapf(err, "failed to delete route to %s", route.Dst)
+		}
+	}
+	return nil
+}
+
+// gcAllowlist is parsed from gc_allowlist, CIDRs protect routes, the others
+// are name patterns of links.
+type gcAllowlist struct {
+	patterns []string
+	cidrs    []*net.IPNet
+}
+
+func parseGCAllowlist(entries []string) (gcAllowlist, error) {
+	allowlist := gcAllowlist{}
+	for _, entry := range entries {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			allowlist.cidrs = append(allowlist.cidrs, cidr)
+			continue
+		}
+		if _, err := filepath.Match(entry, ""); err != nil {
+			return allowlist, errors.Wrapf(err, "invalid gc_allowlist entry %q", entry)
+		}
+		allowlist.patterns = append(allowlist.patterns, entry)
+	}
+	return allowlist, nil
+}
+
+func (a gcAllowlist) allowsLink(name string) bool {
+	for _, pattern := range a.patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a gcAllowlist) allowsIP(ip net.IP) bool {
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func printGCReport(w io.Writer, report *GCReport, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(report))
+	case "", "text":
+	default:
+		return errors.Errorf("unknown output format %q", output)
+	}
+	status := "deleted"
+	if report.DryRun {
+		status = "would delete"
+	}
+	for _, link := range report.Links {
+		fmt.Fprintf(w, "link\t%s\t%s\n", link, status)
+	}
+	for _, route := range report.Routes {
+		fmt.Fprintf(w, "route\t%s\t%s\n", route, status)
+	}
+	return nil
+}
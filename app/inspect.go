@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/inventory"
+	invFact "github.com/projecteru2/docker-cni/inventory/factory"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// ContainerRecord is what the store knows about a container.
+type ContainerRecord struct {
+	ID         string                     `json:"id"`
+	Name       string                     `json:"name,omitempty"`   // resolved by the inventory, empty if the container is removed
+	Holder     string                     `json:"holder,omitempty"` // the container inheriting the network, see ip_identity
+	State      specs.State                `json:"state"`
+	Interfaces []*store.InterfaceInfo     `json:"interfaces"`
+	CNIResults map[string]json.RawMessage `json:"cni_results,omitempty"` // by interface name, inspect only
+}
+
+func runList(_ handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var records []*ContainerRecord
+		if err = requestDaemon(conf, http.MethodGet, "/v1/containers", nil, &records); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			records, err = listContainerRecords(conf)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return printContainerRecords(os.Stdout, records, c.String("output"))
+	}
+}
+
+func runInspect(_ handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		id := c.Args().First()
+		if id == "" {
+			return errors.New("container ID is required")
+		}
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var record *ContainerRecord
+		if err = requestDaemon(conf, http.MethodGet, "/v1/containers/"+url.PathEscape(id), nil, &record); isDaemonUnavailable(err) {
+			if err := initStore(conf); err != nil {
+				return errors.WithStack(err)
+			}
+			defer stor.Close()
+			record, err = inspectContainer(conf, id)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(record))
+	}
+}
+
+// listContainerRecords returns the stored containers in the order of IDs.
+func listContainerRecords(conf config.Config) ([]*ContainerRecord, error) {
+	holders, err := inheritedHolders()
+	if err != nil {
+		return nil, err
+	}
+	// names are nice to have, don't fail the listing for them
+	inv, err := invFact.NewInventory(conf)
+	if err != nil {
+		log.Warnf("[list] failed to create inventory, names are left out: %v", err)
+	}
+
+	records := []*ContainerRecord{}
+	err = stor.ForEachContainer(func(id string, state *specs.State, infos []*store.InterfaceInfo) error {
+		record := &ContainerRecord{ID: id, Holder: holders[id], State: *state, Interfaces: infos}
+		record.Name = containerName(inv, record)
+		records = append(records, record)
+		return nil
+	})
+	return records, errors.WithStack(err)
+}
+
+// inspectContainer returns the records of the container, with its CNI results.
+// id is either the ID the records are stored under, the ID of the container
+// inheriting them, or a unique prefix of either.
+func inspectContainer(conf config.Config, id string) (*ContainerRecord, error) {
+	records, err := listContainerRecords(conf)
+	if err != nil {
+		return nil, err
+	}
+	var found *ContainerRecord
+	for _, record := range records {
+		if record.ID == id || record.Holder == id {
+			found = record
+			break
+		}
+		if strings.HasPrefix(record.ID, id) || (record.Holder != "" && strings.HasPrefix(record.Holder, id)) {
+			if found != nil {
+				return nil, errors.Errorf("multiple containers match %s", id)
+			}
+			found = record
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("no such container: %s", id)
+	}
+
+	results, err := stor.ListCNIResults(found.ID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	found.CNIResults = map[string]json.RawMessage{}
+	for ifname, result := range results {
+		if !json.Valid(result) {
+			return nil, errors.Errorf("invalid CNI result of %s of container %s", ifname, found.ID)
+		}
+		found.CNIResults[ifname] = result
+	}
+	return found, nil
+}
+
+// inheritedHolders maps the IDs the records are stored under to the
+// containers inheriting them.
+func inheritedHolders() (map[string]string, error) {
+	reservations, err := stor.ListReservations()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	holders := map[string]string{}
+	for _, reservation := range reservations {
+		if reservation.Holder != "" && reservation.Holder != reservation.ContainerID {
+			holders[reservation.ContainerID] = reservation.Holder
+		}
+	}
+	return holders, nil
+}
+
+func containerName(inv inventory.Inventory, record *ContainerRecord) string {
+	if inv == nil {
+		return ""
+	}
+	id := record.ID
+	if record.Holder != "" {
+		id = record.Holder
+	}
+	name, err := inv.ContainerName(id)
+	if err != nil {
+		log.Debugf("[list] failed to get name of container %s: %v", id, err)
+		return ""
+	}
+	return name
+}
+
+// printContainerRecords prints one line per interface, or the records in JSON.
+func printContainerRecords(w io.Writer, records []*ContainerRecord, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(records))
+	case "", "text":
+	default:
+		return errors.Errorf("unknown output format %q", output)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tNAME\tIFNAME\tHOST IFNAME\tMAC\tIPS\tSTATUS\tADDED")
+	for _, record := range records {
+		id := record.ID
+		if record.Holder != "" {
+			id = record.Holder
+		}
+		for _, info := range record.Interfaces {
+			added := "-"
+			if !info.AddedAt.IsZero() {
+				added = info.AddedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				shortID(id), orDash(record.Name), info.IFName, orDash(info.HostIFName), orDash(info.MAC),
+				orDash(strings.Join(info.IPs, ",")), orDash(record.State.Status), added)
+		}
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
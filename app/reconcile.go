@@ -0,0 +1,204 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netlink"
+)
+
+func runReconcile(handler handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[reconcile] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		interval := c.Duration("interval")
+		for {
+			log.Info("[reconcile] docker-cni running reconcile")
+			if err = reconcileOnce(handler, conf); err != nil && interval == 0 {
+				return err
+			}
+			if err != nil {
+				log.Errorf("[reconcile] failed to reconcile: %+v", err)
+			}
+			if interval == 0 {
+				return nil
+			}
+			time.Sleep(interval)
+		}
+	}
+}
+
+// reconcileOnce goes through the daemon if it's up, otherwise the store is
+// only held during the run.
+func reconcileOnce(handler handler.Handler, conf config.Config) error {
+	if err := requestDaemon(conf, http.MethodPost, "/v1/reconcile", nil, nil); !isDaemonUnavailable(err) {
+		return err
+	}
+	if err := initStore(conf); err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		stor.Close()
+		stor = nil
+	}()
+	return HandleReconcile(handler, conf)
+}
+
+// HandleReconcile fixes the drift between the store and the host:
+//
+//  1. cleans removed containers, collects garbage and recovers running ones,
+//     see HandleClean, HandleGC and HandleRecover
+//  2. flags the interfaces whose container netns no longer carries the recorded IPs
+//  3. deletes the host routes to the IPs of containers which are not running,
+//     through host veths with host_veth_prefix
+func HandleReconcile(handler handler.Handler, conf config.Config) error {
+	var err2 error
+	if _, err := HandleClean(handler, conf, CleanOptions{}); err != nil {
+		log.Errorf("[reconcile] failed to clean up: %+v", err)
+		err2 = err
+	}
+	// collect the leftovers of failed restores before recovering them
+	if _, err := HandleGC(conf, false); err != nil {
+		log.Errorf("[reconcile] failed to collect garbage: %+v", err)
+		err2 = err
+	}
+	if err := HandleRecover(handler, conf); err != nil {
+		log.Errorf("[reconcile] failed to recover: %+v", err)
+		err2 = err
+	}
+
+	containers, err := listRecordedContainers()
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		for _, info := range container.infos {
+			if container.dead {
+				if err = deleteHostRoutes(conf, info); err != nil {
+					log.Errorf("[reconcile] failed to delete host routes of container %s: %+v", container.state.ID, err)
+					err2 = err
+				}
+				continue
+			}
+			if !container.running {
+				continue
+			}
+			drift, err := checkDrift(&container.state, info)
+			if err != nil {
+				log.Errorf("[reconcile] failed to check %s of container %s: %+v", info.IFName, container.state.ID, err)
+				err2 = err
+				continue
+			}
+			if drift == info.Drift {
+				continue
+			}
+			if drift != "" {
+				log.Warnf("[reconcile] %s of container %s drifted: %s", info.IFName, container.state.ID, drift)
+			}
+			info.Drift = drift
+			if err = stor.PutInterfaceInfo(container.state.ID, info); err != nil {
+				log.Errorf("[reconcile] failed to store interface info: %+v", err)
+				err2 = err
+			}
+		}
+	}
+	return err2
+}
+
+// checkDrift returns which recorded IPs are missing in the container netns,
+// empty if none.
+func checkDrift(state *specs.State, info *store.InterfaceInfo) (drift string, err error) {
+	err = ns.WithNetNSPath(netnsPath(state), func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(info.IFName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				drift = "interface is gone"
+				return nil
+			}
+			return errors.Wrapf(err, "failed to lookup %q", info.IFName)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list addresses of %s", info.IFName)
+		}
+		missing := []string{}
+		for _, ip := range info.IPs {
+			found := false
+			for _, addr := range addrs {
+				if addr.IP.Equal(hostRouteDst(ip).IP) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, ip)
+			}
+		}
+		if len(missing) != 0 {
+			drift = "missing ips " + strings.Join(missing, ",")
+		}
+		return nil
+	})
+	return drift, errors.WithStack(err)
+}
+
+// deleteHostRoutes deletes the routes to the IPs of info through host veths
+// with the prefix, they are left behind if the container is not running.
+func deleteHostRoutes(conf config.Config, info *store.InterfaceInfo) error {
+	for _, ip := range info.IPs {
+		dst := hostRouteDst(ip)
+		if dst == nil {
+			continue
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list routes to %s", dst)
+		}
+		for _, route := range routes {
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil || !strings.HasPrefix(link.Attrs().Name, conf.HostVethPrefix) {
+				continue
+			}
+			log.Infof("[reconcile] deleting route to %s via %s", dst, link.Attrs().Name)
+			if err = netlink.RouteDel(&route); err != nil {
+				return errors.Wrapf(err, "failed to delete route to %s", dst)
+			}
+		}
+	}
+	return nil
+}
+
+// hostRouteDst is the /32 or /128 of ip, with or without prefix length.
+func hostRouteDst(ip string) *net.IPNet {
+	addr := net.ParseIP(strings.SplitN(ip, "/", 2)[0])
+	if addr == nil {
+		return nil
+	}
+	if addr.To4() != nil {
+		return &net.IPNet{IP: addr.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"github.com/vishvananda/netlink"
+)
+
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+func runRecover(handler handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[recover] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Info("[recover] docker-cni running recover")
+		if err = requestDaemon(conf, http.MethodPost, "/v1/recover", nil, nil); !isDaemonUnavailable(err) {
+			return err
+		}
+		if err := initStore(conf); err != nil {
+			return errors.WithStack(err)
+		}
+		defer stor.Close()
+		return HandleRecover(handler, conf)
+	}
+}
+
+// HandleRecover re-plumbs the interfaces of running containers which no longer
+// match the host, e.g. the host routes are flushed, or the host veth is gone.
+// Stopped containers and the ones not started since the host booted are left
+// to the prestart hook.
+func HandleRecover(handler handler.Handler, conf config.Config) error {
+	containers, err := listRecordedContainers()
+	if err != nil {
+		return err
+	}
+
+	var err2 error
+	for _, container := range containers {
+		if !container.running {
+			continue
+		}
+		for _, info := range container.infos {
+			if err = recoverInterface(handler, conf, &container.state, info); err != nil {
+				log.Errorf("[recover] failed to recover %s of container %s: %+v", info.IFName, container.state.ID, err)
+				err2 = err
+			}
+		}
+	}
+	return err2
+}
+
+// recordedContainer is a container in the store with its interfaces, the
+// state ID is the one the records are stored under.
+// Containers recorded by older versions may be neither running nor dead.
+type recordedContainer struct {
+	state   specs.State
+	infos   []*store.InterfaceInfo
+	running bool // the pid and netns in state belong to the container
+	dead    bool // the container is not running for sure
+}
+
+func listRecordedContainers() ([]*recordedContainer, error) {
+	bootID, err := currentBootID()
+	if err != nil {
+		return nil, err
+	}
+	states, err := stor.ListContainerStates()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	containers := []*recordedContainer{}
+	for id, state := range states {
+		infos, err := stor.ListInterfaceInfo(id)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		state.ID = id
+		container := &recordedContainer{state: state, infos: infos}
+		containers = append(containers, container)
+
+		plumbedBootID := ""
+		if len(infos) != 0 {
+			plumbedBootID = infos[0].BootID
+		}
+		_, err = os.Stat(netnsPath(&state))
+		// the pid of a container plumbed before reboot belongs to someone else now,
+		// so does the one of a container gone without the poststop hook
+		owned, err2 := ownsPid(&state)
+		if err2 != nil {
+			return nil, err2
+		}
+		stamped := state.Annotations[pidStartTimeAnnotation] != ""
+		container.dead = state.Status == "stopped" || state.Pid == 0 || err != nil ||
+			(plumbedBootID != "" && plumbedBootID != bootID) || (stamped && !owned)
+		container.running = !container.dead && owned && plumbedBootID == bootID
+	}
+	return containers, nil
+}
+
+// pidStartTimeAnnotation of the stored state is the start time of its pid, to
+// tell the container from a process reusing the pid after the container is
+// gone. The states stored by older versions don't have it.
+const pidStartTimeAnnotation = "docker-cni.pid-start-time"
+
+// stampPid records the start time of the pid in the state to be stored.
+func stampPid(state *specs.State) error {
+	startTime, err := pidStartTime(state.Pid)
+	if err != nil {
+		return err
+	}
+	if state.Annotations == nil {
+		state.Annotations = map[string]string{}
+	}
+	state.Annotations[pidStartTimeAnnotation] = startTime
+	return nil
+}
+
+// ownsPid tells if the pid of the stored state still belongs to the container.
+func ownsPid(state *specs.State) (bool, error) {
+	recorded := state.Annotations[pidStartTimeAnnotation]
+	if recorded == "" || state.Pid == 0 {
+		return false, nil
+	}
+	startTime, err := pidStartTime(state.Pid)
+	if os.IsNotExist(errors.Cause(err)) {
+		return false, nil
+	}
+	return startTime == recorded, err
+}
+
+// pidStartTime returns the start time of the process in clock ticks after boot,
+// the 22nd field of /proc/<pid>/stat.
+func pidStartTime(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	// the command in the 2nd field may contain spaces and parentheses
+	i := strings.LastIndexByte(string(data), ')')
+	fields := strings.Fields(string(data[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return "", errors.Errorf("invalid stat of pid %d", pid)
+	}
+	return fields[19], nil
+}
+
+func recoverInterface(handler handler.Handler, conf config.Config, state *specs.State, info *store.InterfaceInfo) error {
+	nw, err := newNetwork(conf, info.Type)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = fillFromCNIResult(info, state.ID); err != nil {
+		return err
+	}
+
+	contIntact, err := containerLinkExists(state, info.IFName)
+	if err != nil {
+		return err
+	}
+	hostIntact := true
+	if info.HostIFName != "" {
+		hostVeth, err := generic.LookupLink(info.HostIFName)
+		if err != nil {
+			return err
+		}
+		hostIntact = hostVeth != nil
+	}
+
+	switch {
+	case !contIntact || !hostIntact:
+		log.Infof("[recover] rebuilding %s of container %s", info.IFName, state.ID)
+		if contIntact {
+			if err = deleteContainerLink(state, info.IFName); err != nil {
+				return err
+			}
+		}
+		if err = nw.SimulateCNIAdd(info, state); err != nil {
+			return errors.WithStack(err)
+		}
+	default:
+		recoverer, ok := nw.(network.Recoverer)
+		if !ok {
+			return nil
+		}
+		intact, err := recoverer.HostIntact(info)
+		if err != nil || intact {
+			return errors.WithStack(err)
+		}
+		log.Infof("[recover] recovering host side of %s of container %s", info.IFName, state.ID)
+		if err = recoverer.RecoverHost(info, state); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return replayPortMappings(handler, conf, state, info, "add")
+}
+
+func containerLinkExists(state *specs.State, ifname string) (exists bool, err error) {
+	err = ns.WithNetNSPath(netnsPath(state), func(_ ns.NetNS) error {
+		link, err := generic.LookupLink(ifname)
+		exists = link != nil
+		return err
+	})
+	return exists, errors.WithStack(err)
+}
+
+func deleteContainerLink(state *specs.State, ifname string) error {
+	return errors.WithStack(ns.WithNetNSPath(netnsPath(state), func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return errors.Wrapf(err, "failed to lookup %q", ifname)
+		}
+		return errors.Wrapf(netlink.LinkDel(link), "failed to delete %q", ifname)
+	}))
+}
+
+func netnsPath(state *specs.State) string {
+	return fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+}
+
+func currentBootID() (string, error) {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	invFact "github.com/projecteru2/docker-cni/inventory/factory"
+	"github.com/projecteru2/docker-cni/oci"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// reservationKey returns the key the network of the container is reserved by,
+// the container ID unless ip_identity says otherwise.
+func reservationKey(conf config.Config, state *specs.State) (string, error) {
+	switch conf.IPIdentity {
+	case "", "id":
+		return state.ID, nil
+	case "name", "key":
+	default:
+		return "", errors.Errorf("unknown ip_identity %q", conf.IPIdentity)
+	}
+	containerMeta, err := oci.LoadContainerMeta(filepath.Join(state.Bundle, "config.json"))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if key := containerMeta.IPKey(); key != "" {
+		return key, nil
+	}
+	if conf.IPIdentity == "key" {
+		return state.ID, nil
+	}
+	inv, err := invFact.NewInventory(conf)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return inv.ContainerName(state.ID)
+}
+
+// claimReservation makes the container the holder of the reservation of its
+// key, and returns the ID its records are stored under, which is the ID of the
+// first holder.
+func claimReservation(conf config.Config, state *specs.State) (string, error) {
+	key, err := reservationKey(conf, state)
+	if err != nil {
+		return "", err
+	}
+	reservation, err := stor.GetReservation(key)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	switch {
+	case reservation == nil:
+		reservation = &store.Reservation{Key: key, ContainerID: state.ID}
+	case reservation.Holder != state.ID:
+		inv, err := invFact.NewInventory(conf)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		containerIDs, err := inv.ContainerIDs()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if _, alive := containerIDs[reservation.Holder]; alive {
+			return "", errors.Errorf("%q is reserved by container %s", key, reservation.Holder)
+		}
+		log.Infof("[hook] container %s inherits the network of container %s reserved by %q", state.ID, reservation.ContainerID, key)
+	}
+	reservation.Holder, reservation.ReleasedAt = state.ID, time.Time{}
+	return reservation.ContainerID, errors.WithStack(stor.PutReservation(reservation))
+}
+
+// recordID returns the ID the records of the container are stored under.
+func recordID(id string) (string, error) {
+	reservations, err := stor.ListReservations()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, reservation := range reservations {
+		if reservation.Holder == id {
+			return reservation.ContainerID, nil
+		}
+	}
+	return id, nil
+}
+
+// reservedContainerIDs adds the records held by reservations to containerIDs:
+// the holder is alive, or it's removed within the grace period. The expired
+// reservations are dropped, so are all the released ones if force is set.
+// Nothing is written with dry run.
+func reservedContainerIDs(conf config.Config, containerIDs map[string]struct{}, opts CleanOptions) (map[string]struct{}, error) {
+	reservations, err := stor.ListReservations()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	states, err := stor.ListContainerStates()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	reserved := map[string]struct{}{}
+	for _, reservation := range reservations {
+		reserved[reservation.ContainerID] = struct{}{}
+	}
+	// records stored before reservations were introduced are bound to their IDs
+	for id := range states {
+		_, alive := containerIDs[id]
+		if _, ok := reserved[id]; !ok && !alive {
+			reservations = append(reservations, &store.Reservation{Key: id, ContainerID: id, Holder: id})
+		}
+	}
+
+	keep := make(map[string]struct{}, len(containerIDs))
+	for id := range containerIDs {
+		keep[id] = struct{}{}
+	}
+	now := time.Now()
+	for _, reservation := range reservations {
+		if _, alive := containerIDs[reservation.Holder]; alive {
+			keep[reservation.ContainerID] = struct{}{}
+			continue
+		}
+		if !opts.Force {
+			if reservation.ReleasedAt.IsZero() {
+				// dry run judges by the same release time, only not storing it
+				reservation.ReleasedAt = now
+				if !opts.DryRun {
+					if err = stor.PutReservation(reservation); err != nil {
+						return nil, errors.WithStack(err)
+					}
+					if conf.IPReleaseGrace > 0 {
+						log.Infof("[hook] container %s is removed, keeping the network reserved by %q for %v", reservation.Holder, reservation.Key, conf.IPReleaseGrace)
+					}
+				}
+			}
+			if now.Sub(reservation.ReleasedAt) < conf.IPReleaseGrace {
+				keep[reservation.ContainerID] = struct{}{}
+				continue
+			}
+		}
+		if opts.DryRun {
+			continue
+		}
+		log.Infof("[hook] releasing the network of container %s reserved by %q since %v", reservation.ContainerID, reservation.Key, reservation.ReleasedAt)
+		if err = stor.DeleteReservation(reservation.Key); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return keep, nil
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTestStore opens a temporary bbolt store as the store of the app, with
+// one CNI network net1.
+func setupTestStore(t *testing.T) config.Config {
+	dir := t.TempDir()
+	conf := config.Config{
+		CNIConfDir: filepath.Join(dir, "net.d"),
+		StoreFile:  filepath.Join(dir, "store.db"),
+	}
+	require.NoError(t, os.MkdirAll(conf.CNIConfDir, 0755))
+	netconf := `{"cniVersion":"0.4.0","name":"net1","plugins":[{"type":"calico"}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(conf.CNIConfDir, "10-net1.conflist"), []byte(netconf), 0644))
+
+	require.Nil(t, stor, "the store of the app is taken")
+	require.NoError(t, initStore(conf))
+	t.Cleanup(func() {
+		stor.Close()
+		stor = nil
+	})
+	return conf
+}
+
+func TestReservedContainerIDsDryRun(t *testing.T) {
+	for _, grace := range []time.Duration{0, time.Hour} {
+		t.Run(grace.String(), func(t *testing.T) {
+			conf := setupTestStore(t)
+			conf.IPReleaseGrace = grace
+			// c1 is just removed, c2 is alive
+			require.NoError(t, stor.PutReservation(&store.Reservation{Key: "web", ContainerID: "c1", Holder: "c1"}))
+			require.NoError(t, stor.PutReservation(&store.Reservation{Key: "db", ContainerID: "c2", Holder: "c2"}))
+			alive := map[string]struct{}{"c2": {}}
+
+			dryRun, err := reservedContainerIDs(conf, alive, CleanOptions{DryRun: true})
+			require.NoError(t, err)
+			reservation, err := stor.GetReservation("web")
+			require.NoError(t, err)
+			assert.True(t, reservation.ReleasedAt.IsZero(), "dry run writes nothing")
+
+			keep, err := reservedContainerIDs(conf, alive, CleanOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, keep, dryRun)
+			if grace == 0 {
+				assert.Equal(t, map[string]struct{}{"c2": {}}, keep)
+			} else {
+				assert.Equal(t, map[string]struct{}{"c1": {}, "c2": {}}, keep)
+			}
+		})
+	}
+}
+
+func TestReservedContainerIDsGrace(t *testing.T) {
+	conf := setupTestStore(t)
+	conf.IPReleaseGrace = time.Hour
+	now := time.Now()
+	for _, reservation := range []*store.Reservation{
+		// the network of c1 is held by its successor c2
+		{Key: "web", ContainerID: "c1", Holder: "c2"},
+		// removed just now, a while ago, and beyond the grace period
+		{Key: "db", ContainerID: "c3", Holder: "c3"},
+		{Key: "cache", ContainerID: "c4", Holder: "c4", ReleasedAt: now.Add(-time.Minute)},
+		{Key: "queue", ContainerID: "c5", Holder: "c5", ReleasedAt: now.Add(-2 * time.Hour)},
+	} {
+		require.NoError(t, stor.PutReservation(reservation))
+	}
+	alive := map[string]struct{}{"c2": {}}
+
+	keep, err := reservedContainerIDs(conf, alive, CleanOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"c1": {}, "c2": {}, "c3": {}, "c4": {}}, keep)
+
+	// the removal is stored, the expired reservation is dropped
+	reservation, err := stor.GetReservation("db")
+	require.NoError(t, err)
+	assert.WithinDuration(t, now, reservation.ReleasedAt, time.Second)
+	reservation, err = stor.GetReservation("queue")
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+
+	// force drops all but the held ones
+	keep, err = reservedContainerIDs(conf, alive, CleanOptions{Force: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"c1": {}, "c2": {}}, keep)
+	reservations, err := stor.ListReservations()
+	require.NoError(t, err)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "web", reservations[0].Key)
+}
+
+func TestReservedContainerIDsLegacyRecords(t *testing.T) {
+	conf := setupTestStore(t)
+	conf.IPReleaseGrace = time.Hour
+	// stored before reservations were introduced
+	require.NoError(t, stor.PutContainerState("c1", &specs.State{ID: "c1"}))
+	require.NoError(t, stor.PutContainerState("c2", &specs.State{ID: "c2"}))
+
+	keep, err := reservedContainerIDs(conf, map[string]struct{}{"c2": {}}, CleanOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"c1": {}, "c2": {}}, keep)
+	// the removed one is bound to its ID for the grace period
+	reservation, err := stor.GetReservation("c1")
+	require.NoError(t, err)
+	require.NotNil(t, reservation)
+	assert.Equal(t, store.Reservation{Key: "c1", ContainerID: "c1", Holder: "c1", ReleasedAt: reservation.ReleasedAt}, *reservation)
+	assert.False(t, reservation.ReleasedAt.IsZero())
+	reservation, err = stor.GetReservation("c2")
+	assert.NoError(t, err)
+	assert.Nil(t, reservation, "the alive one is left alone")
+
+	keep, err = reservedContainerIDs(conf, map[string]struct{}{"c2": {}}, CleanOptions{Force: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"c2": {}}, keep)
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/handler"
+	"github.com/projecteru2/docker-cni/store/bbolt"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func runStoreMigrate(_ handler.Handler) func(*cli.Context) error {
+	return func(c *cli.Context) (err error) {
+		defer func() {
+			if err != nil {
+				log.Errorf("[store] failed to preceed: %+v", err)
+			}
+		}()
+
+		conf, err := config.LoadConfig(c.String("config"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = conf.SetupLog(); err != nil {
+			return errors.WithStack(err)
+		}
+		if conf.StoreDriver != "bbolt" {
+			return errors.Errorf("store migrate is for the bbolt store, not %s", conf.StoreDriver)
+		}
+		// the daemon holds the store file, and migrated it when it started
+		if conf.DaemonSocket != "" {
+			if conn, err := net.DialTimeout("unix", conf.DaemonSocket, time.Second); err == nil {
+				conn.Close()
+				return errors.Errorf("the daemon is running on %s, stop it first", conf.DaemonSocket)
+			}
+		}
+
+		report, err := bbolt.Migrate(conf, c.Bool("dry-run"))
+		if err != nil {
+			return err
+		}
+		return printMigrationReport(os.Stdout, report, c.String("output"))
+	}
+}
+
+func printMigrationReport(w io.Writer, report *bbolt.MigrationReport, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.WithStack(encoder.Encode(report))
+	case "", "text":
+	default:
+		return errors.Errorf("unknown output format %q", output)
+	}
+	if len(report.Migrations) == 0 {
+		fmt.Fprintf(w, "schema version %d is up to date\n", report.From)
+		return nil
+	}
+	status := "migrated"
+	if report.DryRun {
+		status = "would migrate"
+	}
+	for _, m := range report.Migrations {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Description, status)
+	}
+	if report.Backup != "" {
+		fmt.Fprintf(w, "backup\t%s\n", report.Backup)
+	}
+	return nil
+}
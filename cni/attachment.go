@@ -0,0 +1,80 @@
+package cni
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attachment connects a container to a network through an interface.
+// An empty Network means the default network in the conf dir.
+type Attachment struct {
+	Network        string                 `json:"network,omitempty"`
+	IfName         string                 `json:"if_name"`
+	Args           string                 `json:"args,omitempty"`            // CNI_ARGS, e.g. IP=10.0.0.1
+	CapabilityArgs map[string]interface{} `json:"capability_args,omitempty"` // runtime config for plugins, e.g. portMappings
+}
+
+// ParseAttachments parses the comma separated "network[:ifname]" list, the
+// interfaces default to defaultIfname for the first network and net1, net2...
+// for the others, the next free one if the name is taken by another network.
+// An empty list attaches to the default network only.
+func ParseAttachments(networks, defaultIfname string) ([]Attachment, error) {
+	if strings.TrimSpace(networks) == "" {
+		return []Attachment{{IfName: defaultIfname}}, nil
+	}
+
+	attachments := []Attachment{}
+	named := map[string]struct{}{}
+	for _, item := range strings.Split(networks, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		att := Attachment{Network: parts[0]}
+		if len(parts) == 2 {
+			if att.IfName = parts[1]; att.IfName == "" {
+				return nil, fmt.Errorf("invalid network attachment %q", item)
+			}
+			named[att.IfName] = struct{}{}
+		}
+		if att.Network == "" {
+			return nil, fmt.Errorf("invalid network attachment %q", item)
+		}
+		attachments = append(attachments, att)
+	}
+
+	seen := map[string]struct{}{}
+	for i := range attachments {
+		att := &attachments[i]
+		switch {
+		case att.IfName != "":
+		case i == 0:
+			att.IfName = defaultIfname
+		default:
+			for n := i; ; n++ {
+				att.IfName = fmt.Sprintf("net%d", n)
+				_, taken := named[att.IfName]
+				if _, ok := seen[att.IfName]; !ok && !taken {
+					break
+				}
+			}
+		}
+		if _, ok := seen[att.IfName]; ok {
+			return nil, fmt.Errorf("duplicated interface %s in network attachments %q", att.IfName, networks)
+		}
+		seen[att.IfName] = struct{}{}
+	}
+	return attachments, nil
+}
+
+// ResolveAttachments picks the attachments of a container: the networks list
+// wins over the single network, which wins over the default network.
+func ResolveAttachments(networks, network, defaultNetwork, defaultIfname string) ([]Attachment, error) {
+	if networks != "" {
+		return ParseAttachments(networks, defaultIfname)
+	}
+	if network == "" {
+		network = defaultNetwork
+	}
+	if strings.ContainsAny(network, ",:") {
+		return nil, fmt.Errorf("invalid network name %q", network)
+	}
+	return []Attachment{{Network: network, IfName: defaultIfname}}, nil
+}
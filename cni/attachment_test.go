@@ -0,0 +1,59 @@
+package cni
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAttachments(t *testing.T) {
+	cases := []struct {
+		networks string
+		expected []Attachment
+		err      string
+	}{
+		{"", []Attachment{{IfName: "eth0"}}, ""},
+		{"a", []Attachment{{Network: "a", IfName: "eth0"}}, ""},
+		{"a, b ,c", []Attachment{{Network: "a", IfName: "eth0"}, {Network: "b", IfName: "net1"}, {Network: "c", IfName: "net2"}}, ""},
+		{"a:eth1,b", []Attachment{{Network: "a", IfName: "eth1"}, {Network: "b", IfName: "net1"}}, ""},
+		// the named ones are skipped by the others
+		{"a,b:net2,c", []Attachment{{Network: "a", IfName: "eth0"}, {Network: "b", IfName: "net2"}, {Network: "c", IfName: "net3"}}, ""},
+		{"a,b,c:net1", []Attachment{{Network: "a", IfName: "eth0"}, {Network: "b", IfName: "net2"}, {Network: "c", IfName: "net1"}}, ""},
+		{"a:x,b:x", nil, "duplicated interface x"},
+		{"a,b:eth0", nil, "duplicated interface eth0"},
+		{"a,,b", nil, "invalid network attachment"},
+		{"a:", nil, "invalid network attachment"},
+		{":eth1", nil, "invalid network attachment"},
+	}
+	for _, c := range cases {
+		attachments, err := ParseAttachments(c.networks, "eth0")
+		if c.err != "" {
+			assert.ErrorContains(t, err, c.err, c.networks)
+			continue
+		}
+		if assert.NoError(t, err, c.networks) {
+			assert.Equal(t, c.expected, attachments, c.networks)
+		}
+	}
+}
+
+func TestResolveAttachments(t *testing.T) {
+	attachments, err := ResolveAttachments("a,b", "c", "d", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Attachment{{Network: "a", IfName: "eth0"}, {Network: "b", IfName: "net1"}}, attachments)
+
+	attachments, err = ResolveAttachments("", "c", "d", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Attachment{{Network: "c", IfName: "eth0"}}, attachments)
+
+	attachments, err = ResolveAttachments("", "", "d", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Attachment{{Network: "d", IfName: "eth0"}}, attachments)
+
+	attachments, err = ResolveAttachments("", "", "", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Attachment{{IfName: "eth0"}}, attachments)
+
+	_, err = ResolveAttachments("", "c:eth1", "", "eth0")
+	assert.ErrorContains(t, err, "invalid network name")
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/types"
+	log "github.com/sirupsen/logrus"
 )
 
 // Protocol parameters are passed to the plugins via OS environment variables.
@@ -22,14 +23,17 @@ const (
 
 // CNIToolConfig .
 type CNIToolConfig struct {
-	CNIPath     string `json:"cni_path"`
-	NetConfPath string `json:"net_conf_path"`
-	NetNS       string `json:"net_ns"`
-	Args        string `json:"args"`
-	IfName      string `json:"if_name"`
-	Cmd         string `json:"cmd"`
-	ContainerID string `json:"container_id"`
-	Handler     func([]byte) ([]byte, error)
+	CNIPath        string                 `json:"cni_path"`
+	NetConfPath    string                 `json:"net_conf_path"`
+	NetName        string                 `json:"net_name"` // name of the network to use, the first one in NetConfPath if empty
+	NetNS          string                 `json:"net_ns"`
+	Args           string                 `json:"args"`
+	CapabilityArgs map[string]interface{} `json:"capability_args"`
+	IfName         string                 `json:"if_name"`
+	Cmd            string                 `json:"cmd"`
+	ContainerID    string                 `json:"container_id"`
+	PrevResult     []byte                 `json:"-"` // result of ADD, passed as prevResult on CHECK and DEL
+	Handler        func([]byte) ([]byte, error)
 }
 
 func parseArgs(args string) ([][2]string, error) {
@@ -130,9 +134,87 @@ func LoadConfList(dir string, handler func([]byte) ([]byte, error)) (*libcni.Net
 	return libcni.ConfListFromConf(singleConf)
 }
 
+// LoadConfListByName loads the network named name from dir, both conflist and conf files are considered.
+// Invalid files are skipped, they only fail the lookup if none is named name.
+func LoadConfListByName(dir, name string, handler func([]byte) ([]byte, error)) (*libcni.NetworkConfigList, error) {
+	confs, invalid, err := loadAllConfLists(dir, handler)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, conf := range confs {
+		if conf.Name == name {
+			return conf, nil
+		}
+		names = append(names, conf.Name)
+	}
+	if len(invalid) != 0 {
+		return nil, fmt.Errorf("unknown network %q, available networks in %s: [%s], invalid files: [%s]", name, dir, strings.Join(names, ", "), strings.Join(invalid, ", "))
+	}
+	return nil, fmt.Errorf("unknown network %q, available networks in %s: [%s]", name, dir, strings.Join(names, ", "))
+}
+
+// loadAllConfLists loads the networks in dir, along with the invalid files.
+func loadAllConfLists(dir string, handler func([]byte) ([]byte, error)) (confs []*libcni.NetworkConfigList, invalid []string, err error) {
+	files, err := libcni.ConfFiles(dir, []string{".conflist", ".conf", ".json"})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(files)
+
+	confs, invalid = []*libcni.NetworkConfigList{}, []string{}
+	for _, confFile := range files {
+		var conf *libcni.NetworkConfigList
+		if strings.HasSuffix(confFile, ".conflist") {
+			conf, err = ConfListFromFile(confFile, handler)
+		} else {
+			var singleConf *libcni.NetworkConfig
+			if singleConf, err = ConfFromFile(confFile, handler); err == nil {
+				conf, err = libcni.ConfListFromConf(singleConf)
+			}
+		}
+		if err != nil {
+			// a broken file of another network is none of our business
+			log.Warnf("[cni] skipping invalid network config %s: %v", confFile, err)
+			invalid = append(invalid, filepath.Base(confFile))
+			continue
+		}
+		confs = append(confs, conf)
+	}
+	return confs, invalid, nil
+}
+
+func loadNetConf(config CNIToolConfig) (*libcni.NetworkConfigList, error) {
+	if config.NetName != "" {
+		return LoadConfListByName(config.NetConfPath, config.NetName, config.Handler)
+	}
+	return LoadConfList(config.NetConfPath, config.Handler)
+}
+
+// NetworkName returns the name of the network config would run against.
+func NetworkName(config CNIToolConfig) (string, error) {
+	netconf, err := loadNetConf(config)
+	if err != nil {
+		return "", err
+	}
+	return netconf.Name, nil
+}
+
+// PluginType returns the type of the main plugin, i.e. the first one, of the network.
+func PluginType(config CNIToolConfig) (string, error) {
+	netconf, err := loadNetConf(config)
+	if err != nil {
+		return "", err
+	}
+	if len(netconf.Plugins) == 0 {
+		return "", fmt.Errorf("no plugin in network %s", netconf.Name)
+	}
+	return netconf.Plugins[0].Network.Type, nil
+}
+
 // Run .
 func Run(config CNIToolConfig) (types.Result, error) {
-	netconf, err := LoadConfList(config.NetConfPath, config.Handler)
+	netconf, err := loadNetConf(config)
 	if err != nil {
 		return nil, err
 	}
@@ -148,10 +230,17 @@ func Run(config CNIToolConfig) (types.Result, error) {
 	cninet := libcni.NewCNIConfig(filepath.SplitList(config.CNIPath), nil)
 
 	rt := &libcni.RuntimeConf{
-		ContainerID: config.ContainerID,
-		NetNS:       config.NetNS,
-		IfName:      config.IfName,
-		Args:        cniArgs,
+		ContainerID:    config.ContainerID,
+		NetNS:          config.NetNS,
+		IfName:         config.IfName,
+		Args:           cniArgs,
+		CapabilityArgs: config.CapabilityArgs,
+	}
+
+	if len(config.PrevResult) != 0 && config.Cmd != CmdAdd {
+		if err = seedCachedResult(cninet, netconf, rt, config.PrevResult); err != nil {
+			return nil, err
+		}
 	}
 
 	switch config.Cmd {
@@ -0,0 +1,65 @@
+package cni
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfs writes the files into a new conf dir.
+func writeConfs(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestLoadConfListByName(t *testing.T) {
+	dir := writeConfs(t, map[string]string{
+		"10-a.conflist": `{"cniVersion":"0.4.0","name":"a","plugins":[{"type":"calico"},{"type":"portmap"}]}`,
+		"20-b.conf":     `{"cniVersion":"0.4.0","name":"b","type":"bridge"}`,
+		"30-c.json":     `{"cniVersion":"0.4.0","name":"c","type":"macvlan"}`,
+	})
+
+	conf, err := LoadConfListByName(dir, "a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "a", conf.Name)
+	assert.Len(t, conf.Plugins, 2)
+
+	// single confs are converted to lists
+	for _, name := range []string{"b", "c"} {
+		conf, err = LoadConfListByName(dir, name, nil)
+		require.NoError(t, err)
+		assert.Equal(t, name, conf.Name)
+		assert.Len(t, conf.Plugins, 1)
+	}
+
+	_, err = LoadConfListByName(dir, "d", nil)
+	assert.ErrorContains(t, err, "available networks in "+dir+": [a, b, c]")
+
+	// the handler sees the files first
+	conf, err = LoadConfListByName(dir, "a", func(data []byte) ([]byte, error) {
+		return []byte(`{"cniVersion":"0.4.0","name":"a","plugins":[{"type":"ipvlan"}]}`), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ipvlan", conf.Plugins[0].Network.Type)
+}
+
+func TestLoadConfListByNameSkipsInvalid(t *testing.T) {
+	dir := writeConfs(t, map[string]string{
+		"00-broken.conflist": `{"name":`,
+		"10-a.conflist":      `{"cniVersion":"0.4.0","name":"a","plugins":[{"type":"calico"}]}`,
+		"20-empty.conf":      `{"cniVersion":"0.4.0","name":"empty"}`,
+	})
+
+	conf, err := LoadConfListByName(dir, "a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "a", conf.Name)
+
+	_, err = LoadConfListByName(dir, "broken", nil)
+	assert.ErrorContains(t, err, "invalid files: [00-broken.conflist, 20-empty.conf]")
+}
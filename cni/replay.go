@@ -0,0 +1,93 @@
+package cni
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types/create"
+)
+
+// ReplayPlugin runs config.Cmd, ADD or DEL, of the chained plugins of
+// pluginType in the network alone, with config.PrevResult as prevResult. It's
+// used to apply or take down the host side settings of plugins like portmap
+// without touching IPAM.
+func ReplayPlugin(config CNIToolConfig, pluginType string) error {
+	netconf, err := loadNetConf(config)
+	if err != nil {
+		return err
+	}
+	prevResult, err := create.CreateFromBytes(config.PrevResult)
+	if err != nil {
+		return fmt.Errorf("error decoding prevResult: %w", err)
+	}
+	if prevResult, err = prevResult.GetAsVersion(netconf.CNIVersion); err != nil {
+		return fmt.Errorf("failed to convert prevResult to version %q: %w", netconf.CNIVersion, err)
+	}
+
+	var cniArgs [][2]string
+	if len(config.Args) > 0 {
+		if cniArgs, err = parseArgs(config.Args); err != nil {
+			return err
+		}
+	}
+	command := "ADD"
+	switch config.Cmd {
+	case CmdAdd, "":
+	case CmdDel:
+		command = "DEL"
+	default:
+		return fmt.Errorf("unsupported command %v to replay", config.Cmd)
+	}
+	paths := filepath.SplitList(config.CNIPath)
+
+	for _, plugin := range netconf.Plugins {
+		if plugin.Network.Type != pluginType {
+			continue
+		}
+		// the same injection as libcni does for chained plugins
+		values := map[string]interface{}{
+			"name":       netconf.Name,
+			"cniVersion": netconf.CNIVersion,
+			"prevResult": prevResult,
+		}
+		runtimeConfig := map[string]interface{}{}
+		for capability, supported := range plugin.Network.Capabilities {
+			if data, ok := config.CapabilityArgs[capability]; ok && supported {
+				runtimeConfig[capability] = data
+			}
+		}
+		if len(runtimeConfig) > 0 {
+			values["runtimeConfig"] = runtimeConfig
+		}
+		pluginConf, err := libcni.InjectConf(plugin, values)
+		if err != nil {
+			return err
+		}
+
+		pluginPath, err := invoke.FindInPath(pluginType, paths)
+		if err != nil {
+			return err
+		}
+		args := &invoke.Args{
+			Command:     command,
+			ContainerID: config.ContainerID,
+			NetNS:       config.NetNS,
+			PluginArgs:  cniArgs,
+			IfName:      config.IfName,
+			Path:        strings.Join(paths, string(filepath.ListSeparator)),
+		}
+		if command == "DEL" {
+			err = invoke.ExecPluginWithoutResult(context.TODO(), pluginPath, pluginConf.Bytes, args, nil)
+		} else {
+			_, err = invoke.ExecPluginWithResult(context.TODO(), pluginPath, pluginConf.Bytes, args, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("plugin %s failed (%s): %w", pluginType, config.Cmd, err)
+		}
+	}
+	return nil
+}
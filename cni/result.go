@@ -0,0 +1,61 @@
+package cni
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/types/create"
+)
+
+// ParseResult decodes a versioned CNI result and converts it to the current version.
+func ParseResult(raw []byte) (*current.Result, error) {
+	res, err := create.CreateFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding CNI result: %w", err)
+	}
+	return current.NewResultFromResult(res)
+}
+
+// ResultIPs returns the addresses in CIDR notation assigned to ifname by the result.
+func ResultIPs(raw []byte, ifname string) ([]string, error) {
+	res, err := ParseResult(raw)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, ipc := range res.IPs {
+		if ipc.Interface != nil && *ipc.Interface < len(res.Interfaces) && res.Interfaces[*ipc.Interface].Name != ifname {
+			continue
+		}
+		ips = append(ips, ipc.Address.String())
+	}
+	return ips, nil
+}
+
+// ResultDNS returns the dns settings of the result.
+func ResultDNS(raw []byte) (types.DNS, error) {
+	res, err := ParseResult(raw)
+	if err != nil {
+		return types.DNS{}, err
+	}
+	return res.DNS, nil
+}
+
+// seedCachedResult writes prevResult into the libcni cache unless there is a
+// cached result already, so DEL and CHECK hand it to the plugins as
+// prevResult even if the cache was wiped, e.g. by a host reboot.
+func seedCachedResult(cninet *libcni.CNIConfig, netconf *libcni.NetworkConfigList, rt *libcni.RuntimeConf, prevResult []byte) error {
+	if cached, err := cninet.GetNetworkListCachedResult(netconf, rt); err == nil && cached != nil {
+		return nil
+	}
+	// libcni reads a bare result in the cache file as a legacy cache entry
+	filename := filepath.Join(libcni.CacheDir, "results", fmt.Sprintf("%s-%s-%s", netconf.Name, rt.ContainerID, rt.IfName))
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return fmt.Errorf("error creating CNI cache dir: %w", err)
+	}
+	return os.WriteFile(filename, prevResult, 0600)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"github.com/mcuadros/go-defaults"
 	"github.com/pkg/errors"
@@ -12,6 +13,7 @@ type Config struct {
 	OCIBin string `yaml:"oci_bin" default:"/usr/bin/runc"`
 
 	CNIConfDir string `yaml:"cni_conf_dir" default:"/etc/cni/net.d/"`
+	CNINetwork string `yaml:"cni_network"` // default network name, the first config in cni_conf_dir if empty
 	CNIType    string `yaml:"cni_type" default:"calico"`
 	CNIBinDir  string `yaml:"cni_bin_dir" default:"/opt/cni/bin/"`
 	CNIIfname  string `yaml:"cni_ifname" default:"eth0"`
@@ -25,8 +27,55 @@ type Config struct {
 	BinPathname     string
 	OCISpecFilename string
 
-	FixedIP   bool   `yaml:"fixed_ip" default:"true"`
-	StoreFile string `yaml:"store_file" default:"/var/lib/docker-cni/store.db"`
+	// the hooks and commands go through the daemon listening here if it's up
+	DaemonSocket string `yaml:"daemon_socket" default:"/run/docker-cni/docker-cni.sock"`
+	// a request to the daemon fails if it's not answered in time
+	DaemonTimeout time.Duration `yaml:"daemon_timeout" default:"2m"`
+	// the daemon reconciles the store and the host every interval if set
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	// host veths with the prefix are owned by docker-cni, reconcile removes the dangling ones
+	HostVethPrefix string `yaml:"host_veth_prefix" default:"cali"`
+	// never touched by gc: name patterns of links, e.g. cali-keep*, or CIDRs of routes
+	GCAllowlist []string `yaml:"gc_allowlist"`
+
+	FixedIP bool `yaml:"fixed_ip" default:"true"`
+	// where the records live: "bbolt" (store_file), "json" (plain files under
+	// store_dir) or "etcd", shared by the nodes of a cluster, each under
+	// <etcd_prefix>/nodes/<etcd_node_name>
+	StoreDriver string `yaml:"store_driver" default:"bbolt"`
+	StoreFile   string `yaml:"store_file" default:"/var/lib/docker-cni/store.db"`
+	StoreDir    string `yaml:"store_dir" default:"/var/lib/docker-cni/store"`
+
+	EtcdEndpoints []string      `yaml:"etcd_endpoints"`
+	EtcdPrefix    string        `yaml:"etcd_prefix" default:"/docker-cni"`
+	EtcdNodeName  string        `yaml:"etcd_node_name"` // hostname if empty
+	EtcdLeaseTTL  time.Duration `yaml:"etcd_lease_ttl" default:"30s"`
+	EtcdCAFile    string        `yaml:"etcd_ca_file"`
+	EtcdCertFile  string        `yaml:"etcd_cert_file"`
+	EtcdKeyFile   string        `yaml:"etcd_key_file"`
+
+	// fixed_ip only: what the network of a container is reserved by, "id", "name"
+	// (IP_KEY or the container name) or "key" (IP_KEY, the ID if absent), and
+	// how long the clean task keeps the network after the container is removed,
+	// released by the next clean if 0
+	IPIdentity     string        `yaml:"ip_identity" default:"id"`
+	IPReleaseGrace time.Duration `yaml:"ip_release_grace"`
+
+	// where to learn which containers exist: "docker" (engine API, falls back
+	// to docker_data_root only if unreachable), "data_root" or "containerd"
+	Inventory           string `yaml:"inventory" default:"docker"`
+	DockerHost          string `yaml:"docker_host" default:"unix:///var/run/docker.sock"`
+	DockerDataRoot      string `yaml:"docker_data_root" default:"/var/lib/docker"`
+	CtrBin              string `yaml:"ctr_bin" default:"/usr/bin/ctr"`
+	ContainerdAddress   string `yaml:"containerd_address" default:"/run/containerd/containerd.sock"`
+	ContainerdNamespace string `yaml:"containerd_namespace" default:"default"`
+
+	// render /etc/resolv.conf and /etc/hosts of containers from the CNI result,
+	// dns_* override the dns of the result
+	DNSFiles       bool     `yaml:"dns_files"`
+	DNSNameservers []string `yaml:"dns_nameservers"`
+	DNSSearch      []string `yaml:"dns_search"`
+	DNSOptions     []string `yaml:"dns_options"`
 }
 
 func LoadConfig(path string) (conf Config, err error) {
@@ -40,12 +89,34 @@ func LoadConfig(path string) (conf Config, err error) {
 	defaults.SetDefaults(&conf)
 	conf.BinPathname = os.Args[0]
 	conf.Filename = path
-	return
+	return conf, conf.validateFile()
 }
 
+// Validate checks the config of the oci wrapper, the file is checked by
+// LoadConfig already.
 func (c Config) Validate() error {
 	if c.OCISpecFilename == "" {
 		return errors.Errorf("invalid config: oci spec filename is required")
 	}
+	return c.validateFile()
+}
+
+// validateFile checks the keys of the config file, so that every command
+// fails early on them rather than halfway.
+func (c Config) validateFile() error {
+	switch c.IPIdentity {
+	case "id", "name", "key":
+	default:
+		return errors.Errorf("invalid config: unknown ip_identity %q", c.IPIdentity)
+	}
+	switch c.StoreDriver {
+	case "bbolt", "json":
+	case "etcd":
+		if len(c.EtcdEndpoints) == 0 {
+			return errors.Errorf("invalid config: etcd_endpoints is required by the etcd store")
+		}
+	default:
+		return errors.Errorf("invalid config: unknown store_driver %q", c.StoreDriver)
+	}
 	return nil
 }
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadConfig(t *testing.T, content string) (Config, error) {
+	path := filepath.Join(t.TempDir(), "cni.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return LoadConfig(path)
+}
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := loadConfig(t, "cni_bin_dir: /opt/cni/bin\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/opt/cni/bin", conf.CNIBinDir)
+	assert.Equal(t, "bbolt", conf.StoreDriver)
+	assert.Equal(t, "id", conf.IPIdentity)
+
+	conf, err = loadConfig(t, "store_driver: etcd\netcd_endpoints: [127.0.0.1:2379]\nip_identity: name\n")
+	require.NoError(t, err)
+	assert.Equal(t, "etcd", conf.StoreDriver)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{"store_driver: sqlite\n", `unknown store_driver "sqlite"`},
+		{"store_driver: BBOLT\n", `unknown store_driver "BBOLT"`},
+		{"store_driver: etcd\n", "etcd_endpoints is required"},
+		{"ip_identity: ip\n", `unknown ip_identity "ip"`},
+	}
+	for _, c := range cases {
+		_, err := loadConfig(t, c.content)
+		assert.ErrorContains(t, err, c.err, c.content)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	conf, err := loadConfig(t, "")
+	require.NoError(t, err)
+	assert.ErrorContains(t, conf.Validate(), "oci spec filename is required")
+	conf.OCISpecFilename = "/run/bundle/config.json"
+	assert.NoError(t, conf.Validate())
+}
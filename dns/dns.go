@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Config is what goes into resolv.conf.
+type Config struct {
+	Nameservers []string
+	Domain      string
+	Search      []string
+	Options     []string
+}
+
+func (c Config) Empty() bool {
+	return len(c.Nameservers) == 0 && c.Domain == "" && len(c.Search) == 0 && len(c.Options) == 0
+}
+
+func RenderResolvConf(c Config) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by docker-cni\n")
+	for _, ns := range c.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if c.Domain != "" {
+		fmt.Fprintf(&buf, "domain %s\n", c.Domain)
+	}
+	if len(c.Search) != 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(c.Search, " "))
+	}
+	if len(c.Options) != 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+// RenderHosts merges the entries of the container into hosts, which is what
+// docker seeded, e.g. with the --add-host entries. The entries of the hostname
+// are replaced by one for every ip of the container, the default entries are
+// rendered if hosts is empty.
+func RenderHosts(hosts []byte, hostname string, ips []string) []byte {
+	var buf bytes.Buffer
+	if len(bytes.TrimSpace(hosts)) == 0 {
+		buf.WriteString("# Generated by docker-cni\n")
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+		buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buf.WriteString("fe00::0\tip6-localnet\n")
+		buf.WriteString("ff00::0\tip6-mcastprefix\n")
+		buf.WriteString("ff02::1\tip6-allnodes\n")
+		buf.WriteString("ff02::2\tip6-allrouters\n")
+	} else {
+		for _, line := range strings.SplitAfter(string(hosts), "\n") {
+			if hostname != "" && isHostnameEntry(line, hostname) {
+				continue
+			}
+			buf.WriteString(line)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteString("\n")
+		}
+	}
+	if hostname == "" {
+		return buf.Bytes()
+	}
+	for _, ip := range ips {
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, hostname)
+	}
+	return buf.Bytes()
+}
+
+// isHostnameEntry tells if all the names of the line are the hostname, with
+// or without a domain.
+func isHostnameEntry(line, hostname string) bool {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, name := range fields[1:] {
+		if name != hostname && !strings.HasPrefix(name, hostname+".") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderHosts(t *testing.T) {
+	seeded := "127.0.0.1\tlocalhost\n" +
+		"10.1.2.3\tregistry.local # --add-host\n" +
+		"172.17.0.2\tweb web.example.com\n" +
+		"192.168.0.1\tweb-db"
+
+	assert.Equal(t, "127.0.0.1\tlocalhost\n"+
+		"10.1.2.3\tregistry.local # --add-host\n"+
+		"192.168.0.1\tweb-db\n"+
+		"10.0.0.2\tweb\n", string(RenderHosts([]byte(seeded), "web", []string{"10.0.0.2"})))
+
+	// rendering again replaces the entries of the hostname
+	rendered := RenderHosts([]byte(seeded), "web", []string{"10.0.0.2"})
+	assert.Equal(t, string(rendered), string(RenderHosts(rendered, "web", []string{"10.0.0.2"})))
+
+	assert.Contains(t, string(RenderHosts(nil, "web", []string{"10.0.0.2"})), "127.0.0.1\tlocalhost\n")
+}
@@ -1,19 +1,30 @@
 package cni
 
 import (
+	"encoding/json"
 	"strings"
 
+	"github.com/pkg/errors"
+	cnilib "github.com/projecteru2/docker-cni/cni"
 	"github.com/projecteru2/docker-cni/config"
 	"github.com/projecteru2/docker-cni/oci"
 )
 
 func (h *CNIHandler) HandleCreate(conf config.Config, containerMeta *oci.ContainerMeta) (err error) {
+	if err = h.ValidateNetworks(conf, containerMeta); err != nil {
+		return
+	}
 	if err = h.AddCNIStartHook(conf, containerMeta); err != nil {
 		return
 	}
 	if err = h.AddCNIStopHook(conf, containerMeta); err != nil {
 		return
 	}
+	if conf.DNSFiles {
+		if err = containerMeta.BindDNSFiles(); err != nil {
+			return
+		}
+	}
 	return containerMeta.Save()
 }
 
@@ -29,6 +40,12 @@ func (h *CNIHandler) AddCNIStartHook(conf config.Config, containerMeta *oci.Cont
 	if len(cniArgs) != 0 {
 		env = append(env, "CNI_ARGS="+strings.Join(cniArgs, ";"))
 	}
+	env = append(env, networkEnv(containerMeta)...)
+	capabilityEnv, err := capabilityEnv(containerMeta)
+	if err != nil {
+		return
+	}
+	env = append(env, capabilityEnv...)
 	containerMeta.AppendHook("prestart",
 		conf.BinPathname,
 		[]string{conf.BinPathname, "cni", "--config", conf.Filename, "--command", "add"}, // args
@@ -38,10 +55,62 @@ func (h *CNIHandler) AddCNIStartHook(conf config.Config, containerMeta *oci.Cont
 }
 
 func (h *CNIHandler) AddCNIStopHook(conf config.Config, containerMeta *oci.ContainerMeta) (err error) {
+	env := networkEnv(containerMeta)
+	capabilityEnv, err := capabilityEnv(containerMeta)
+	if err != nil {
+		return
+	}
+	env = append(env, capabilityEnv...)
 	containerMeta.AppendHook("poststop",
 		conf.BinPathname,
 		[]string{conf.BinPathname, "cni", "--config", conf.Filename, "--command", "del"}, // args
-		nil, // env
+		env, // env
 	)
 	return
 }
+
+// ValidateNetworks fails the creation if the container asks for unknown networks,
+// rather than the prestart hook.
+func (h *CNIHandler) ValidateNetworks(conf config.Config, containerMeta *oci.ContainerMeta) error {
+	attachments, err := cnilib.ResolveAttachments(containerMeta.SpecificNetworks(), containerMeta.SpecificNetwork(), conf.CNINetwork, conf.CNIIfname)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, att := range attachments {
+		if att.Network == "" {
+			continue
+		}
+		if _, err = cnilib.LoadConfListByName(conf.CNIConfDir, att.Network, h.HandleCNIConfig); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// networkEnv passes the networks the container asks for to the hooks.
+func networkEnv(containerMeta *oci.ContainerMeta) []string {
+	env := []string{}
+	if containerMeta.RequiresSpecificNetworks() {
+		env = append(env, "CNI_NETWORKS="+containerMeta.SpecificNetworks())
+	}
+	if containerMeta.RequiresSpecificNetwork() {
+		env = append(env, "CNI_NETWORK="+containerMeta.SpecificNetwork())
+	}
+	return env
+}
+
+// capabilityEnv passes the capability args of the container to the hooks in JSON.
+func capabilityEnv(containerMeta *oci.ContainerMeta) ([]string, error) {
+	capabilityArgs, err := containerMeta.CapabilityArgs()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(capabilityArgs) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(capabilityArgs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return []string{"CNI_CAPABILITY_ARGS=" + string(data)}, nil
+}
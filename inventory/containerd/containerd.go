@@ -0,0 +1,71 @@
+package containerd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nameLabel is where nerdctl keeps the container name.
+const nameLabel = "nerdctl/name"
+
+// Containerd lists the containers of a containerd namespace with ctr.
+// Docker deletes the containerd container once it exits, so it doesn't work
+// for the moby namespace.
+type Containerd struct {
+	ctr       string
+	address   string
+	namespace string
+}
+
+func New(ctr, address, namespace string) *Containerd {
+	return &Containerd{
+		ctr:       ctr,
+		address:   address,
+		namespace: namespace,
+	}
+}
+
+func (c *Containerd) ContainerIDs() (map[string]struct{}, error) {
+	out, err := c.run("containers", "list", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+	containerIDs := make(map[string]struct{})
+	for _, id := range strings.Fields(string(out)) {
+		containerIDs[id] = struct{}{}
+	}
+	return containerIDs, nil
+}
+
+func (c *Containerd) ContainerName(id string) (string, error) {
+	out, err := c.run("containers", "info", id)
+	if err != nil {
+		return "", err
+	}
+	container := struct {
+		Labels map[string]string
+	}{}
+	if err = json.Unmarshal(out, &container); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if name := container.Labels[nameLabel]; name != "" {
+		return name, nil
+	}
+	return "", errors.Errorf("container %s has no %s label", id, nameLabel)
+}
+
+func (c *Containerd) run(args ...string) ([]byte, error) {
+	args = append([]string{"--address", c.address, "--namespace", c.namespace}, args...)
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.ctr, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run %s %s: %s", c.ctr, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
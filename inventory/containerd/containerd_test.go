@@ -0,0 +1,55 @@
+package containerd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCtr answers the ctr commands used by Containerd, for the address and
+// namespace given. It returns the path of the script.
+func fakeCtr(t *testing.T) string {
+	ctr := filepath.Join(t.TempDir(), "ctr")
+	script := `#!/bin/sh
+[ "$1 $2 $3 $4" = "--address /run/containerd.sock --namespace ns" ] || { echo "unexpected flags: $*" >&2; exit 1; }
+shift 4
+case "$*" in
+"containers list --quiet")
+	printf 'web\ndb\n' ;;
+"containers info web")
+	echo '{"ID":"web","Labels":{"nerdctl/name":"web-1"}}' ;;
+"containers info db")
+	echo '{"ID":"db","Labels":{}}' ;;
+*)
+	echo "container \"$3\" in namespace \"ns\": not found" >&2; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(ctr, []byte(script), 0755))
+	return ctr
+}
+
+func TestContainerIDs(t *testing.T) {
+	c := New(fakeCtr(t), "/run/containerd.sock", "ns")
+	ids, err := c.ContainerIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"web": {}, "db": {}}, ids)
+
+	_, err = New(fakeCtr(t), "/run/containerd.sock", "other").ContainerIDs()
+	assert.ErrorContains(t, err, "unexpected flags")
+}
+
+func TestContainerName(t *testing.T) {
+	c := New(fakeCtr(t), "/run/containerd.sock", "ns")
+	name, err := c.ContainerName("web")
+	assert.NoError(t, err)
+	assert.Equal(t, "web-1", name)
+
+	_, err = c.ContainerName("db")
+	assert.ErrorContains(t, err, "has no nerdctl/name label")
+
+	_, err = c.ContainerName("missing")
+	assert.ErrorContains(t, err, `container "missing" in namespace "ns": not found`)
+}
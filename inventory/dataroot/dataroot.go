@@ -0,0 +1,49 @@
+package dataroot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DataRoot reads the containers directory under the docker data-root.
+type DataRoot struct {
+	root string
+}
+
+func New(root string) *DataRoot {
+	return &DataRoot{root: root}
+}
+
+func (d *DataRoot) ContainerIDs() (map[string]struct{}, error) {
+	files, err := os.ReadDir(filepath.Join(d.root, "containers"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Using empty struct{} as value since we only care about existence
+	containerIDs := make(map[string]struct{})
+	for _, f := range files {
+		if f.IsDir() {
+			containerIDs[f.Name()] = struct{}{}
+		}
+	}
+	return containerIDs, nil
+}
+
+func (d *DataRoot) ContainerName(id string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(d.root, "containers", id, "config.v2.json"))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	container := struct {
+		Name string
+	}{}
+	if err = json.Unmarshal(data, &container); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimPrefix(container.Name, "/"), nil
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/inventory"
+)
+
+const timeout = 10 * time.Second
+
+// Docker asks the docker engine API.
+type Docker struct {
+	host   string
+	base   string
+	client *http.Client
+}
+
+// New accepts hosts in the form of DOCKER_HOST, unix:// or tcp://.
+func New(host string) (*Docker, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid docker host %q", host)
+	}
+	d := &Docker{
+		host:   host,
+		client: &http.Client{Timeout: timeout},
+	}
+	network, address := "tcp", u.Host
+	switch u.Scheme {
+	case "unix":
+		d.base = "http://docker"
+		network, address = "unix", u.Path
+	case "tcp", "http":
+		d.base = "http://" + u.Host
+	default:
+		return nil, errors.Errorf("unsupported docker host %q", host)
+	}
+	d.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil {
+				// the engine is down, not just failing
+				return nil, inventory.UnavailableError{Err: err}
+			}
+			return conn, nil
+		},
+	}
+	return d, nil
+}
+
+func (d *Docker) ContainerIDs() (map[string]struct{}, error) {
+	containers := []struct {
+		ID string `json:"Id"`
+	}{}
+	if err := d.get("/containers/json?all=1", &containers); err != nil {
+		return nil, err
+	}
+	containerIDs := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		containerIDs[c.ID] = struct{}{}
+	}
+	return containerIDs, nil
+}
+
+// ContainerName lists the container instead of inspecting it, inspect waits
+// for the container lock, which is held by docker while starting it, i.e.
+// when the hooks run.
+func (d *Docker) ContainerName(id string) (string, error) {
+	filters, err := json.Marshal(map[string][]string{"id": {id}})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	containers := []struct {
+		ID    string `json:"Id"`
+		Names []string
+	}{}
+	if err = d.get("/containers/json?all=1&filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return "", err
+	}
+	for _, c := range containers {
+		// the filter matches ID prefixes
+		if c.ID == id && len(c.Names) != 0 {
+			return strings.TrimPrefix(c.Names[0], "/"), nil
+		}
+	}
+	return "", errors.Errorf("no such container: %s", id)
+}
+
+func (d *Docker) get(path string, v interface{}) error {
+	resp, err := d.client.Get(d.base + path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to request docker %s", d.host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		return errors.Errorf("GET %s: %s", path, statusText(resp.StatusCode, msg.Message))
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+func statusText(code int, message string) string {
+	if message == "" {
+		return fmt.Sprintf("%d %s", code, http.StatusText(code))
+	}
+	return fmt.Sprintf("%d %s", code, message)
+}
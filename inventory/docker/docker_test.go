@@ -0,0 +1,133 @@
+package docker
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/projecteru2/docker-cni/inventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupFakeDocker serves a few engine API endpoints on a unix socket.
+// It returns the docker host and a cleanup function.
+func setupFakeDocker(t *testing.T) (string, func()) {
+	tmpDir, err := os.MkdirTemp("", "docker-test-*")
+	require.NoError(t, err)
+	sock := filepath.Join(tmpDir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("filters") {
+		case "":
+			w.Write([]byte(`[{"Id":"running","Names":["/web"]},{"Id":"stopped","Names":["/db"]}]`))
+		case `{"id":["running"]}`:
+			w.Write([]byte(`[{"Id":"running","Names":["/web"]}]`))
+		case `{"id":["broken"]}`:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"daemon is not ready"}`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+
+	cleanup := func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	}
+	return "unix://" + sock, cleanup
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("unix:///var/run/docker.sock")
+	assert.NoError(t, err)
+	_, err = New("tcp://127.0.0.1:2375")
+	assert.NoError(t, err)
+	_, err = New("ssh://docker")
+	assert.Error(t, err)
+}
+
+func TestContainerIDs(t *testing.T) {
+	host, cleanup := setupFakeDocker(t)
+	defer cleanup()
+
+	d, err := New(host)
+	require.NoError(t, err)
+	ids, err := d.ContainerIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"running": {}, "stopped": {}}, ids)
+}
+
+func TestContainerName(t *testing.T) {
+	host, cleanup := setupFakeDocker(t)
+	defer cleanup()
+
+	d, err := New(host)
+	require.NoError(t, err)
+	name, err := d.ContainerName("running")
+	assert.NoError(t, err)
+	assert.Equal(t, "web", name)
+
+	_, err = d.ContainerName("missing")
+	assert.ErrorContains(t, err, "no such container")
+
+	_, err = d.ContainerName("broken")
+	assert.ErrorContains(t, err, "500 daemon is not ready")
+}
+
+func TestUnreachable(t *testing.T) {
+	d, err := New("unix://" + filepath.Join(t.TempDir(), "docker.sock"))
+	require.NoError(t, err)
+	_, err = d.ContainerIDs()
+	assert.True(t, inventory.IsUnavailable(err))
+}
+
+// staleInventory stands for the data root, which may miss live containers.
+type staleInventory struct {
+	calls int
+}
+
+func (s *staleInventory) ContainerIDs() (map[string]struct{}, error) {
+	s.calls++
+	return map[string]struct{}{}, nil
+}
+
+func (s *staleInventory) ContainerName(string) (string, error) {
+	s.calls++
+	return "stale", nil
+}
+
+func TestFallback(t *testing.T) {
+	host, cleanup := setupFakeDocker(t)
+	defer cleanup()
+	d, err := New(host)
+	require.NoError(t, err)
+
+	// docker answers, even if with an error
+	secondary := &staleInventory{}
+	inv := inventory.Fallback{Primary: d, Secondary: secondary}
+	ids, err := inv.ContainerIDs()
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+	_, err = inv.ContainerName("broken")
+	assert.ErrorContains(t, err, "500 daemon is not ready")
+	assert.Zero(t, secondary.calls)
+
+	// docker is down
+	d, err = New("unix://" + filepath.Join(t.TempDir(), "docker.sock"))
+	require.NoError(t, err)
+	inv = inventory.Fallback{Primary: d, Secondary: secondary}
+	name, err := inv.ContainerName("running")
+	assert.NoError(t, err)
+	assert.Equal(t, "stale", name)
+	_, err = inv.ContainerIDs()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, secondary.calls)
+}
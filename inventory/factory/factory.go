@@ -0,0 +1,29 @@
+package factory
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/inventory"
+	"github.com/projecteru2/docker-cni/inventory/containerd"
+	"github.com/projecteru2/docker-cni/inventory/dataroot"
+	"github.com/projecteru2/docker-cni/inventory/docker"
+)
+
+func NewInventory(conf config.Config) (inventory.Inventory, error) {
+	switch strings.ToLower(conf.Inventory) {
+	case "docker":
+		d, err := docker.New(conf.DockerHost)
+		if err != nil {
+			return nil, err
+		}
+		return inventory.Fallback{Primary: d, Secondary: dataroot.New(conf.DockerDataRoot)}, nil
+	case "data_root":
+		return dataroot.New(conf.DockerDataRoot), nil
+	case "containerd":
+		return containerd.New(conf.CtrBin, conf.ContainerdAddress, conf.ContainerdNamespace), nil
+	default:
+		return nil, fmt.Errorf("unsupported inventory: %s", conf.Inventory)
+	}
+}
@@ -0,0 +1,59 @@
+package inventory
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Inventory tells which containers exist on the host, stopped ones included.
+type Inventory interface {
+	// ContainerIDs returns the full IDs of all containers.
+	ContainerIDs() (map[string]struct{}, error)
+	// ContainerName returns the name of the container, without the leading slash.
+	ContainerName(id string) (string, error)
+}
+
+// UnavailableError means the inventory can't be reached at all, e.g. the
+// socket of the daemon is missing, rather than it fails to answer.
+type UnavailableError struct {
+	Err error
+}
+
+func (e UnavailableError) Error() string {
+	return "inventory unavailable: " + e.Err.Error()
+}
+
+func (e UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func IsUnavailable(err error) bool {
+	var e UnavailableError
+	return errors.As(err, &e)
+}
+
+// Fallback asks Secondary when Primary is unavailable, e.g. the daemon is
+// down. Other errors of Primary are returned as is: Secondary may be stale,
+// and the containers missing in it would be cleaned.
+type Fallback struct {
+	Primary   Inventory
+	Secondary Inventory
+}
+
+func (f Fallback) ContainerIDs() (map[string]struct{}, error) {
+	ids, err := f.Primary.ContainerIDs()
+	if !IsUnavailable(err) {
+		return ids, err
+	}
+	log.Warnf("[inventory] failed to list containers, falling back: %v", err)
+	return f.Secondary.ContainerIDs()
+}
+
+func (f Fallback) ContainerName(id string) (string, error) {
+	name, err := f.Primary.ContainerName(id)
+	if !IsUnavailable(err) {
+		return name, err
+	}
+	log.Warnf("[inventory] failed to get name of container %s, falling back: %v", id, err)
+	return f.Secondary.ContainerName(id)
+}
@@ -0,0 +1,163 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// BridgeNetwork restores containers plumbed by the reference bridge plugin:
+// the container side is replayed like the generic network, and the host veth
+// is enslaved to the recorded bridge again.
+type BridgeNetwork struct {
+	generic *generic.GenericNetwork
+}
+
+func New() *BridgeNetwork {
+	return &BridgeNetwork{
+		generic: generic.New(),
+	}
+}
+
+func (b *BridgeNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.State) (*store.InterfaceInfo, error) {
+	info, err := b.generic.ExtractNetworkInfo(conf, state)
+	if err != nil {
+		return nil, err
+	}
+	if info.HostIFName == "" {
+		return nil, errors.Errorf("%s is not a veth, is it created by bridge plugin?", info.IFName)
+	}
+
+	hostVeth, err := netlink.LinkByName(info.HostIFName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+	}
+	br, err := netlink.LinkByIndex(hostVeth.Attrs().MasterIndex)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get bridge of %s", info.HostIFName)
+	}
+	info.Bridge = br.Attrs().Name
+	info.PromiscMode = br.Attrs().Promisc != 0
+
+	protinfo, err := netlink.LinkGetProtinfo(hostVeth)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get protinfo of %s", info.HostIFName)
+	}
+	info.HairpinMode = protinfo.Hairpin
+
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list bridge vlans")
+	}
+	for _, vlan := range vlans[int32(hostVeth.Attrs().Index)] {
+		// vlan 1 is the default PVID of every bridge port
+		if vlan.PortVID() && vlan.Vid != 1 {
+			info.VLAN = int(vlan.Vid)
+		}
+	}
+	return info, nil
+}
+
+func (b *BridgeNetwork) HostIntact(info *store.InterfaceInfo) (bool, error) {
+	if intact, err := b.generic.HostIntact(info); err != nil || !intact {
+		return intact, err
+	}
+	br, err := generic.LookupLink(info.Bridge)
+	if err != nil || br == nil {
+		return false, err
+	}
+	hostVeth, err := generic.LookupLink(info.HostIFName)
+	if err != nil || hostVeth == nil {
+		return false, err
+	}
+	return hostVeth.Attrs().MasterIndex == br.Attrs().Index, nil
+}
+
+// RecoverHost enslaves the host veth to the bridge again, the bridge must exist.
+func (b *BridgeNetwork) RecoverHost(info *store.InterfaceInfo, state *specs.State) error {
+	br, err := netlink.LinkByName(info.Bridge)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup bridge %q", info.Bridge)
+	}
+	if err = b.generic.RecoverHost(info, state); err != nil {
+		return err
+	}
+	hostVeth, err := netlink.LinkByName(info.HostIFName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+	}
+	if hostVeth.Attrs().MasterIndex == br.Attrs().Index {
+		return nil
+	}
+	if err = attach(info, br); err != nil {
+		return err
+	}
+	log.Infof("[bridge] recovered %s on bridge %s", info.HostIFName, info.Bridge)
+	return nil
+}
+
+// SimulateCNIAdd restores the veth pair like the generic network and attaches
+// it to the bridge, the pair is deleted again if attaching fails.
+func (b *BridgeNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) (err error) {
+	br, err := netlink.LinkByName(info.Bridge)
+	if err != nil {
+		return &network.RestoreError{IFName: info.IFName, Step: "lookup bridge", Err: errors.Wrapf(err, "failed to lookup bridge %q", info.Bridge)}
+	}
+
+	rb := network.NewRollback(info.IFName)
+	defer func() {
+		if err != nil {
+			rb.Undo()
+		}
+	}()
+	if err = rb.Step("restore veth", func() error {
+		return b.generic.SimulateCNIAdd(info, state)
+	}, func() error {
+		return network.DeleteLink(fmt.Sprintf("/proc/%d/ns/net", state.Pid), info.IFName)
+	}); err != nil {
+		return err
+	}
+	if err = rb.Step("attach to bridge", func() error {
+		return attach(info, br)
+	}, nil); err != nil {
+		return err
+	}
+	log.Infof("[bridge] attached %s to bridge %s", info.HostIFName, info.Bridge)
+	return nil
+}
+
+// attach enslaves the host veth of info to br with the recorded port settings.
+func attach(info *store.InterfaceInfo, br netlink.Link) error {
+	hostVeth, err := netlink.LinkByName(info.HostIFName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+	}
+	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return errors.Wrapf(err, "failed to connect %q to bridge %v", info.HostIFName, info.Bridge)
+	}
+	if err = netlink.LinkSetHairpin(hostVeth, info.HairpinMode); err != nil {
+		return errors.Wrapf(err, "failed to setup hairpin mode for %v", info.HostIFName)
+	}
+	if info.VLAN != 0 {
+		// remove default vlan, same as the bridge plugin
+		if err = netlink.BridgeVlanDel(hostVeth, 1, true, true, false, true); err != nil {
+			return errors.Wrapf(err, "failed to remove default vlan on interface %q", info.HostIFName)
+		}
+		if err = netlink.BridgeVlanAdd(hostVeth, uint16(info.VLAN), true, true, false, true); err != nil {
+			return errors.Wrapf(err, "failed to setup vlan tag on interface %q", info.HostIFName)
+		}
+	}
+	if info.PromiscMode {
+		if err = netlink.SetPromiscOn(br); err != nil {
+			return errors.Wrapf(err, "failed to set promisc on bridge %q", info.Bridge)
+		}
+	}
+	return nil
+}
@@ -15,6 +15,8 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/network/generic"
 	"github.com/projecteru2/docker-cni/store"
 	log "github.com/sirupsen/logrus"
 )
@@ -51,20 +53,8 @@ func (_ *CalicoNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.Sta
 			info.IPs = append(info.IPs, addr.IP.String())
 		}
 
-		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
-		if err != nil {
-			return fmt.Errorf("failed to get routes: %v", err)
-		}
-		for _, r := range routes {
-			dst := "default"
-			if r.Dst != nil {
-				dst = r.Dst.String()
-			}
-			via := ""
-			if r.Gw != nil {
-				via = r.Gw.String()
-			}
-			info.Routes = append(info.Routes, fmt.Sprintf("dst=%s via=%s", dst, via))
+		if info.Routes, err = network.ListRoutes(link); err != nil {
+			return err
 		}
 		return nil
 	})
@@ -83,6 +73,9 @@ func (_ *CalicoNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.Sta
 	}
 	return &info, nil
 }
+
+// SimulateCNIAdd recreates the calico veth, each step is undone if a later one
+// fails, so that a failed restore leaves nothing behind.
 func (_ *CalicoNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) (err error) {
 	var hasIPv4, hasIPv6 bool
 	hostVethName := info.HostIFName
@@ -91,69 +84,144 @@ func (_ *CalicoNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.S
 
 	netnsPath := fmt.Sprintf("/proc/%d/ns/net", containerPid)
 
-	ns.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) error {
-		// Create veth pair
-		veth := &netlink.Veth{
-			LinkAttrs: netlink.LinkAttrs{
-				Name:  contVethName,
-				Flags: net.FlagUp,
-				// MTU:   1500,
-			},
-			PeerName: hostVethName,
-		}
-		if err := netlink.LinkAdd(veth); err != nil {
-			return errors.Wrapf(err, "failed to create veth pair %s", hostVethName)
-		}
-		hostVeth, err := netlink.LinkByName(hostVethName)
+	rb := network.NewRollback(contVethName)
+	defer func() {
 		if err != nil {
-			return errors.Wrapf(err, "failed to lookup %q", hostVethName)
+			rb.Undo()
 		}
+	}()
+
+	err = rb.Step("enter container netns", func() error {
+		return ns.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) error {
+			var hostVeth, contVeth netlink.Link
+			// Create veth pair, deleting the container end deletes the host end as well,
+			// wherever it is, together with its routes and sysctls
+			err := rb.Step("create veth", func() error {
+				veth := &netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{
+						Name:  contVethName,
+						Flags: net.FlagUp,
+						// MTU:   1500,
+					},
+					PeerName: hostVethName,
+				}
+				return errors.Wrapf(netlink.LinkAdd(veth), "failed to create veth pair %s", hostVethName)
+			}, func() error {
+				return network.DeleteLink(netnsPath, contVethName)
+			})
+			if err != nil {
+				return err
+			}
 
-		if mac, err := net.ParseMAC("EE:EE:EE:EE:EE:EE"); err != nil {
-			log.Infof("failed to parse MAC Address: %v. Using kernel generated MAC.", err)
-		} else {
-			// Set the MAC address on the host side interface so the kernel does not
-			// have to generate a persistent address which fails some times.
-			if err = netlink.LinkSetHardwareAddr(hostVeth, mac); err != nil {
-				log.Warnf("failed to Set MAC of %q: %v. Using kernel generated MAC.", hostVethName, err)
+			err = rb.Step("set host veth up", func() (err error) {
+				if hostVeth, err = netlink.LinkByName(hostVethName); err != nil {
+					return errors.Wrapf(err, "failed to lookup %q", hostVethName)
+				}
+				if mac, err := net.ParseMAC("EE:EE:EE:EE:EE:EE"); err != nil {
+					log.Infof("failed to parse MAC Address: %v. Using kernel generated MAC.", err)
+				} else {
+					// Set the MAC address on the host side interface so the kernel does not
+					// have to generate a persistent address which fails some times.
+					if err = netlink.LinkSetHardwareAddr(hostVeth, mac); err != nil {
+						log.Warnf("failed to Set MAC of %q: %v. Using kernel generated MAC.", hostVethName, err)
+					}
+				}
+				// Explicitly set the veth to UP state, because netlink doesn't always do that on all the platforms with net.FlagUp.
+				// veth won't get a link local address unless it's set to UP state.
+				return errors.Wrapf(netlink.LinkSetUp(hostVeth), "failed to set %q up", hostVethName)
+			}, nil)
+			if err != nil {
+				return err
 			}
-		}
-		// Explicitly set the veth to UP state, because netlink doesn't always do that on all the platforms with net.FlagUp.
-		// veth won't get a link local address unless it's set to UP state.
-		if err = netlink.LinkSetUp(hostVeth); err != nil {
-			return fmt.Errorf("failed to set %q up: %v", hostVethName, err)
-		}
 
-		contVeth, err := netlink.LinkByName(contVethName)
+			err = rb.Step("configure container veth", func() (err error) {
+				if contVeth, err = netlink.LinkByName(contVethName); err != nil {
+					return errors.Wrapf(err, "failed to lookup %q", contVethName)
+				}
+				if mac, err := net.ParseMAC(info.MAC); err != nil {
+					log.Infof("failed to parse MAC Address: %v. Using kernel generated MAC.", err)
+				} else {
+					if err = netlink.LinkSetHardwareAddr(contVeth, mac); err != nil {
+						log.Warnf("failed to Set MAC of %q: %v. Using kernel generated MAC.", contVethName, err)
+					}
+				}
+				// Fetch the MAC from the container Veth. This is needed by Calico.
+				contVethMAC := contVeth.Attrs().HardwareAddr.String()
+				log.WithField("MAC", contVethMAC).Debug("Found MAC for container veth")
+				hasIPv4, hasIPv6, err = configureInterface(contVeth, hostVeth, info)
+				return errors.Wrapf(err, "failed to configure interface %s", contVethName)
+			}, nil)
+			if err != nil {
+				return err
+			}
+
+			// move host veth to host netns
+			return rb.Step("move host veth", func() error {
+				return errors.Wrap(netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())), "failed to move veth to host netns")
+			}, nil)
+		})
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return rb.Step("configure host veth", func() error {
+		return setupHostVeth(hostVethName, hasIPv4, hasIPv6, info.IPs)
+	}, nil)
+}
+
+func (_ *CalicoNetwork) HostIntact(info *store.InterfaceInfo) (bool, error) {
+	hostVeth, err := generic.LookupLink(info.HostIFName)
+	if err != nil || hostVeth == nil || hostVeth.Attrs().Flags&net.FlagUp == 0 {
+		return false, err
+	}
+	routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list routes of %s", info.HostIFName)
+	}
+	for _, ipStr := range info.IPs {
+		ipnet, err := parseCIDR(ipStr)
 		if err != nil {
-			err = fmt.Errorf("failed to lookup %q: %v", contVethName, err)
-			return err
+			return false, errors.Wrapf(err, "invalid ip: %s", ipStr)
 		}
-
-		if mac, err := net.ParseMAC(info.MAC); err != nil {
-			log.Infof("failed to parse MAC Address: %v. Using kernel generated MAC.", err)
-		} else {
-			// Set the MAC address on the host side interface so the kernel does not
-			// have to generate a persistent address which fails some times.
-			if err = netlink.LinkSetHardwareAddr(contVeth, mac); err != nil {
-				log.Warnf("failed to Set MAC of %q: %v. Using kernel generated MAC.", hostVethName, err)
+		found := false
+		for _, r := range routes {
+			if r.Dst != nil && r.Dst.IP.Equal(ipnet.IP) {
+				found = true
+				break
 			}
 		}
-		// Fetch the MAC from the container Veth. This is needed by Calico.
-		contVethMAC := contVeth.Attrs().HardwareAddr.String()
-		log.WithField("MAC", contVethMAC).Debug("Found MAC for container veth")
-		hasIPv4, hasIPv6, err = configureInterface(contVeth, hostVeth, info)
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RecoverHost brings back the sysctls and routes of the host veth.
+func (_ *CalicoNetwork) RecoverHost(info *store.InterfaceInfo, _ *specs.State) error {
+	var hasIPv4, hasIPv6 bool
+	for _, ipStr := range info.IPs {
+		ipnet, err := parseCIDR(ipStr)
 		if err != nil {
-			log.Errorf("failed to configure interface %s: %v", contVethName, err)
+			return errors.Wrapf(err, "invalid ip: %s", ipStr)
 		}
-		// move host veth to host netns
-		if err = netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())); err != nil {
-			return fmt.Errorf("failed to move veth to host netns: %v", err)
+		if ipnet.IP.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
 		}
-		return nil
-	})
+	}
+	if err := setupHostVeth(info.HostIFName, hasIPv4, hasIPv6, info.IPs); err != nil {
+		return err
+	}
+	log.Infof("[calico] recovered host veth %s", info.HostIFName)
+	return nil
+}
 
-	if err = configureSysctls(hostVethName, hasIPv4, hasIPv6); err != nil {
+// setupHostVeth configures the host veth once it's in host netns.
+func setupHostVeth(hostVethName string, hasIPv4, hasIPv6 bool, ips []string) error {
+	if err := configureSysctls(hostVethName, hasIPv4, hasIPv6); err != nil {
 		return errors.Wrapf(err, "failed to configure sysctls for host veth %s", hostVethName)
 	}
 
@@ -168,7 +236,7 @@ func (_ *CalicoNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.S
 		return errors.Wrapf(err, "failed to set %q up", hostVethName)
 	}
 	// Now that the host side of the veth is moved, state set to UP, and configured with sysctls, we can add the routes to it in the host namespace.
-	err = SetupRoutes(hostVeth, info.IPs)
+	err = SetupRoutes(hostVeth, ips)
 	if err != nil {
 		return fmt.Errorf("error adding host side routes for interface: %s, error: %s", hostVeth.Attrs().Name, err)
 	}
@@ -204,23 +272,26 @@ func configureInterface(contVeth, hostVeth netlink.Link, info *store.InterfaceIn
 		}
 		// Before returning, create the routes inside the namespace, first for IPv4 then IPv6.
 		if version == "4" {
-			// Add a connected route to a dummy next hop so that a default route can be set
-			gw := net.IPv4(169, 254, 1, 1)
-			gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
-			err := netlink.RouteAdd(
-				&netlink.Route{
-					LinkIndex: contVeth.Attrs().Index,
-					Scope:     netlink.SCOPE_LINK,
-					Dst:       gwNet,
-				},
-			)
+			// records without routes were stored by older versions, add the well known calico gateway
+			if len(info.Routes) == 0 {
+				// Add a connected route to a dummy next hop so that a default route can be set
+				gw := net.IPv4(169, 254, 1, 1)
+				gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
+				err := netlink.RouteAdd(
+					&netlink.Route{
+						LinkIndex: contVeth.Attrs().Index,
+						Scope:     netlink.SCOPE_LINK,
+						Dst:       gwNet,
+					},
+				)
 
-			if err != nil {
-				return hasIPv4, hasIPv6, fmt.Errorf("failed to add route inside the container: %v", err)
-			}
+				if err != nil {
+					return hasIPv4, hasIPv6, fmt.Errorf("failed to add route inside the container: %v", err)
+				}
 
-			if err = ip.AddDefaultRoute(gw, contVeth); err != nil {
-				return hasIPv4, hasIPv6, fmt.Errorf("failed to add the default route inside the container: %v", err)
+				if err = ip.AddDefaultRoute(gw, contVeth); err != nil {
+					return hasIPv4, hasIPv6, fmt.Errorf("failed to add the default route inside the container: %v", err)
+				}
 			}
 
 			if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: ipnet}); err != nil {
@@ -248,27 +319,29 @@ func configureInterface(contVeth, hostVeth netlink.Link, info *store.InterfaceIn
 				return hasIPv4, hasIPv6, fmt.Errorf("failed to set net.ipv6.conf.lo.disable_ipv6=0: %s", err)
 			}
 
-			// No need to add a dummy next hop route as the host veth device will already have an IPv6
-			// link local address that can be used as a next hop.
-			// Just fetch the address of the host end of the veth and use it as the next hop.
-			addresses, err := netlink.AddrList(hostVeth, netlink.FAMILY_V6)
-			if err != nil {
-				log.Errorf("Error listing IPv6 addresses for the host side of the veth pair: %s", err)
-				return hasIPv4, hasIPv6, err
-			}
+			if len(info.Routes) == 0 {
+				// No need to add a dummy next hop route as the host veth device will already have an IPv6
+				// link local address that can be used as a next hop.
+				// Just fetch the address of the host end of the veth and use it as the next hop.
+				addresses, err := netlink.AddrList(hostVeth, netlink.FAMILY_V6)
+				if err != nil {
+					log.Errorf("Error listing IPv6 addresses for the host side of the veth pair: %s", err)
+					return hasIPv4, hasIPv6, err
+				}
 
-			if len(addresses) < 1 {
-				// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
-				// support IPv6. Since a IPv6 address has been allocated that can't be used,
-				// return an error.
-				return hasIPv4, hasIPv6, fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
-			}
+				if len(addresses) < 1 {
+					// If the hostVeth doesn't have an IPv6 address then this host probably doesn't
+					// support IPv6. Since a IPv6 address has been allocated that can't be used,
+					// return an error.
+					return hasIPv4, hasIPv6, fmt.Errorf("failed to get IPv6 addresses for host side of the veth pair")
+				}
 
-			hostIPv6Addr := addresses[0].IP
+				hostIPv6Addr := addresses[0].IP
 
-			_, defNet, _ := net.ParseCIDR("::/0")
-			if err = ip.AddRoute(defNet, hostIPv6Addr, contVeth); err != nil {
-				return hasIPv4, hasIPv6, fmt.Errorf("failed to add IPv6 default gateway to %v %v", hostIPv6Addr, err)
+				_, defNet, _ := net.ParseCIDR("::/0")
+				if err = ip.AddRoute(defNet, hostIPv6Addr, contVeth); err != nil {
+					return hasIPv4, hasIPv6, fmt.Errorf("failed to add IPv6 default gateway to %v %v", hostIPv6Addr, err)
+				}
 			}
 
 			if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: ipnet}); err != nil {
@@ -280,6 +353,11 @@ func configureInterface(contVeth, hostVeth netlink.Link, info *store.InterfaceIn
 			hasIPv6 = true
 		}
 	}
+
+	// replay the captured routes, including the ones injected by chained plugins
+	if err = network.AddRoutes(contVeth, info.Routes); err != nil {
+		return hasIPv4, hasIPv6, fmt.Errorf("failed to restore routes inside the container: %v", err)
+	}
 	return hasIPv4, hasIPv6, nil
 }
 
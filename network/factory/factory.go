@@ -5,13 +5,25 @@ import (
 	"strings"
 
 	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/network/bridge"
 	"github.com/projecteru2/docker-cni/network/calico"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/network/ipvlan"
+	"github.com/projecteru2/docker-cni/network/macvlan"
 )
 
 func NewNetwork(networkType string) (network.Network, error) {
 	switch strings.ToLower(networkType) {
 	case "calico":
 		return calico.New(), nil
+	case "bridge":
+		return bridge.New(), nil
+	case "generic":
+		return generic.New(), nil
+	case "macvlan":
+		return macvlan.New(), nil
+	case "ipvlan":
+		return ipvlan.New(), nil
 	default:
 		return nil, fmt.Errorf("unsupported CNI type: %s", networkType)
 	}
@@ -0,0 +1,164 @@
+package generic
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// GenericNetwork restores the container side link of any CNI plugin from a
+// netlink snapshot, it doesn't know anything about the host side except the
+// peer of a veth pair.
+type GenericNetwork struct{}
+
+func New() *GenericNetwork {
+	return &GenericNetwork{}
+}
+
+func (_ *GenericNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.State) (*store.InterfaceInfo, error) {
+	ifname := conf.CNIIfname
+	netnsPath := fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+
+	info := store.InterfaceInfo{
+		IFName: ifname,
+	}
+	var peerIndex int
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get %s", ifname)
+		}
+		if _, ok := link.(*netlink.Veth); ok {
+			peerIndex = link.Attrs().ParentIndex
+		}
+		return CaptureLink(link, &info)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect %s in netns %s", ifname, netnsPath)
+	}
+
+	if peerIndex != 0 {
+		peer, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get host peer of %s", ifname)
+		}
+		info.HostIFName = peer.Attrs().Name
+	}
+	return &info, nil
+}
+
+// SimulateCNIAdd recreates the veth pair, the pair is deleted again if any
+// later step fails.
+func (_ *GenericNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) (err error) {
+	if info.LinkType != "veth" || info.HostIFName == "" {
+		return errors.Errorf("generic network can't recreate %s link %s", info.LinkType, info.IFName)
+	}
+	netnsPath := fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+
+	rb := network.NewRollback(info.IFName)
+	defer func() {
+		if err != nil {
+			rb.Undo()
+		}
+	}()
+
+	err = rb.Step("enter container netns", func() error {
+		return ns.WithNetNSPath(netnsPath, func(hostNS ns.NetNS) error {
+			var hostVeth, contVeth netlink.Link
+			err := rb.Step("create veth", func() (err error) {
+				hostVeth, contVeth, err = CreateVeth(info)
+				return err
+			}, func() error {
+				return network.DeleteLink(netnsPath, info.IFName)
+			})
+			if err != nil {
+				return err
+			}
+			if err = rb.Step("configure container link", func() error {
+				return ConfigureLink(contVeth, info)
+			}, nil); err != nil {
+				return err
+			}
+			return rb.Step("move host veth", func() error {
+				return errors.Wrapf(netlink.LinkSetNsFd(hostVeth, int(hostNS.Fd())), "failed to move %s to host netns", info.HostIFName)
+			}, nil)
+		})
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// Moving a veth between namespaces always leaves it in the "DOWN" state.
+	if err = rb.Step("set host veth up", func() error {
+		hostVeth, err := netlink.LinkByName(info.HostIFName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+		}
+		return errors.Wrapf(netlink.LinkSetUp(hostVeth), "failed to set %q up", info.HostIFName)
+	}, nil); err != nil {
+		return err
+	}
+	log.Infof("[generic] restored %s with peer %s", info.IFName, info.HostIFName)
+	return nil
+}
+
+func (_ *GenericNetwork) HostIntact(info *store.InterfaceInfo) (bool, error) {
+	if info.HostIFName == "" {
+		return true, nil
+	}
+	hostVeth, err := LookupLink(info.HostIFName)
+	if err != nil || hostVeth == nil {
+		return false, err
+	}
+	return hostVeth.Attrs().Flags&net.FlagUp != 0, nil
+}
+
+func (_ *GenericNetwork) RecoverHost(info *store.InterfaceInfo, _ *specs.State) error {
+	if info.HostIFName == "" {
+		return nil
+	}
+	hostVeth, err := netlink.LinkByName(info.HostIFName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+	}
+	return errors.Wrapf(netlink.LinkSetUp(hostVeth), "failed to set %q up", info.HostIFName)
+}
+
+// LookupLink returns nil if there is no such link in the current netns.
+func LookupLink(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil, nil
+	}
+	return link, errors.Wrapf(err, "failed to lookup %q", name)
+}
+
+// CreateVeth creates the veth pair described by info inside the current netns
+// and returns the host and container ends, both still in the current netns.
+func CreateVeth(info *store.InterfaceInfo) (hostVeth, contVeth netlink.Link, err error) {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: info.IFName,
+			MTU:  info.MTU,
+		},
+		PeerName: info.HostIFName,
+	}
+	if err = netlink.LinkAdd(veth); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create veth pair %s", info.HostIFName)
+	}
+	if hostVeth, err = netlink.LinkByName(info.HostIFName); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to lookup %q", info.HostIFName)
+	}
+	if contVeth, err = netlink.LinkByName(info.IFName); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to lookup %q", info.IFName)
+	}
+	return hostVeth, contVeth, nil
+}
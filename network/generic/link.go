@@ -0,0 +1,118 @@
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// CaptureLink snapshots the container side link into info: type, MTU, MAC,
+// addresses with prefix, routes of all tables and static neighbor entries.
+// Must be called inside the container netns.
+func CaptureLink(link netlink.Link, info *store.InterfaceInfo) error {
+	attrs := link.Attrs()
+	info.LinkType = link.Type()
+	info.MTU = attrs.MTU
+	info.MAC = attrs.HardwareAddr.String()
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get addresses of %s", attrs.Name)
+	}
+	for _, addr := range addrs {
+		// link local IPv6 addresses are generated by kernel
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		info.IPs = append(info.IPs, addr.IPNet.String())
+	}
+
+	if info.Routes, err = network.ListRoutes(link); err != nil {
+		return err
+	}
+
+	neighs, err := netlink.NeighList(attrs.Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get neighbors of %s", attrs.Name)
+	}
+	for _, n := range neighs {
+		// dynamic entries are learned again, only keep the ones configured by plugins
+		if n.State&netlink.NUD_PERMANENT == 0 || n.HardwareAddr == nil {
+			continue
+		}
+		info.Neighbors = append(info.Neighbors, store.Neighbor{
+			IP:    n.IP.String(),
+			MAC:   n.HardwareAddr.String(),
+			State: n.State,
+		})
+	}
+	return nil
+}
+
+// ConfigureLink replays what CaptureLink recorded onto a freshly created link.
+// Must be called inside the container netns.
+func ConfigureLink(link netlink.Link, info *store.InterfaceInfo) error {
+	name := link.Attrs().Name
+	if info.MTU != 0 && link.Attrs().MTU != info.MTU {
+		if err := netlink.LinkSetMTU(link, info.MTU); err != nil {
+			return errors.Wrapf(err, "failed to set MTU of %s to %d", name, info.MTU)
+		}
+	}
+	if info.MAC != "" && info.LinkType != "ipvlan" {
+		mac, err := net.ParseMAC(info.MAC)
+		if err != nil {
+			return errors.Wrapf(err, "invalid MAC %s", info.MAC)
+		}
+		if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return errors.Wrapf(err, "failed to set MAC of %s", name)
+		}
+	}
+
+	for _, ipStr := range info.IPs {
+		addr, err := netlink.ParseAddr(ipStr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid ip: %s", ipStr)
+		}
+		if addr.IP.To4() == nil {
+			// skip DAD, otherwise the address stays tentative and routes via it fail
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return errors.Wrapf(err, "failed to add addr %s to %s", ipStr, name)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return errors.Wrapf(err, "failed to set %s up", name)
+	}
+
+	if err := network.AddRoutes(link, info.Routes); err != nil {
+		return err
+	}
+
+	for _, n := range info.Neighbors {
+		mac, err := net.ParseMAC(n.MAC)
+		if err != nil {
+			return errors.Wrapf(err, "invalid neighbor MAC %s", n.MAC)
+		}
+		ip := net.ParseIP(n.IP)
+		family := netlink.FAMILY_V6
+		if ip.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		if err = netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       family,
+			State:        n.State,
+			IP:           ip,
+			HardwareAddr: mac,
+		}); err != nil {
+			return errors.Wrapf(err, "failed to add neighbor %s on %s", n.IP, name)
+		}
+	}
+	return nil
+}
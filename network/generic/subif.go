@@ -0,0 +1,89 @@
+package generic
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/vishvananda/netlink"
+)
+
+// ExtractSubInterface snapshots a sub-interface like macvlan or ipvlan, and
+// resolves the name of its parent in host netns.
+// The returned link carries the type specific attributes, e.g. mode.
+func ExtractSubInterface(conf *config.Config, state *specs.State) (*store.InterfaceInfo, netlink.Link, error) {
+	ifname := conf.CNIIfname
+	netnsPath := fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+
+	info := store.InterfaceInfo{
+		IFName: ifname,
+	}
+	var link netlink.Link
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) (err error) {
+		if link, err = netlink.LinkByName(ifname); err != nil {
+			return errors.Wrapf(err, "failed to get %s", ifname)
+		}
+		return CaptureLink(link, &info)
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to inspect %s in netns %s", ifname, netnsPath)
+	}
+
+	parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to get parent of %s", ifname)
+	}
+	info.Parent = parent.Attrs().Name
+	return &info, link, nil
+}
+
+// RestoreSubInterface creates link on top of info.Parent directly inside the
+// container netns, then replays the recorded configuration on it. The link is
+// deleted again if the configuration fails.
+func RestoreSubInterface(info *store.InterfaceInfo, state *specs.State, link netlink.Link) (err error) {
+	netnsPath := fmt.Sprintf("/proc/%d/ns/net", state.Pid)
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return &network.RestoreError{IFName: info.IFName, Step: "enter container netns", Err: errors.Wrapf(err, "failed to open netns %q", netnsPath)}
+	}
+	defer netns.Close()
+
+	rb := network.NewRollback(info.IFName)
+	defer func() {
+		if err != nil {
+			rb.Undo()
+		}
+	}()
+
+	err = rb.Step("create "+link.Type(), func() error {
+		parent, err := netlink.LinkByName(info.Parent)
+		if err != nil {
+			return errors.Wrapf(err, "failed to lookup parent %q", info.Parent)
+		}
+		attrs := link.Attrs()
+		attrs.Name = info.IFName
+		attrs.MTU = info.MTU
+		attrs.ParentIndex = parent.Attrs().Index
+		attrs.Namespace = netlink.NsFd(int(netns.Fd()))
+		return errors.Wrapf(netlink.LinkAdd(link), "failed to create %s %s on %s", link.Type(), info.IFName, info.Parent)
+	}, func() error {
+		return network.DeleteLink(netnsPath, info.IFName)
+	})
+	if err != nil {
+		return err
+	}
+
+	return rb.Step("configure container link", func() error {
+		return netns.Do(func(_ ns.NetNS) error {
+			contLink, err := netlink.LinkByName(info.IFName)
+			if err != nil {
+				return errors.Wrapf(err, "failed to lookup %q", info.IFName)
+			}
+			return ConfigureLink(contLink, info)
+		})
+	}, nil)
+}
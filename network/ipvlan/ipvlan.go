@@ -0,0 +1,55 @@
+package ipvlan
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+var modes = map[netlink.IPVlanMode]string{
+	netlink.IPVLAN_MODE_L2:  "l2",
+	netlink.IPVLAN_MODE_L3:  "l3",
+	netlink.IPVLAN_MODE_L3S: "l3s",
+}
+
+type IPVlanNetwork struct{}
+
+func New() *IPVlanNetwork {
+	return &IPVlanNetwork{}
+}
+
+func (_ *IPVlanNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.State) (*store.InterfaceInfo, error) {
+	info, link, err := generic.ExtractSubInterface(conf, state)
+	if err != nil {
+		return nil, err
+	}
+	ipvlan, ok := link.(*netlink.IPVlan)
+	if !ok {
+		return nil, errors.Errorf("%s is a %s link, not ipvlan", info.IFName, link.Type())
+	}
+	if info.Mode, ok = modes[ipvlan.Mode]; !ok {
+		return nil, errors.Errorf("unsupported ipvlan mode %d of %s", ipvlan.Mode, info.IFName)
+	}
+	return info, nil
+}
+
+func (_ *IPVlanNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) error {
+	link := &netlink.IPVlan{Mode: netlink.IPVLAN_MODE_MAX}
+	for mode, name := range modes {
+		if name == info.Mode {
+			link.Mode = mode
+		}
+	}
+	if link.Mode == netlink.IPVLAN_MODE_MAX {
+		return errors.Errorf("unknown ipvlan mode %q", info.Mode)
+	}
+	if err := generic.RestoreSubInterface(info, state, link); err != nil {
+		return err
+	}
+	log.Infof("[ipvlan] restored %s on %s", info.IFName, info.Parent)
+	return nil
+}
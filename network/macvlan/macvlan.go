@@ -0,0 +1,56 @@
+package macvlan
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/network/generic"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+var modes = map[netlink.MacvlanMode]string{
+	netlink.MACVLAN_MODE_BRIDGE:   "bridge",
+	netlink.MACVLAN_MODE_PRIVATE:  "private",
+	netlink.MACVLAN_MODE_VEPA:     "vepa",
+	netlink.MACVLAN_MODE_PASSTHRU: "passthru",
+}
+
+type MacvlanNetwork struct{}
+
+func New() *MacvlanNetwork {
+	return &MacvlanNetwork{}
+}
+
+func (_ *MacvlanNetwork) ExtractNetworkInfo(conf *config.Config, state *specs.State) (*store.InterfaceInfo, error) {
+	info, link, err := generic.ExtractSubInterface(conf, state)
+	if err != nil {
+		return nil, err
+	}
+	macvlan, ok := link.(*netlink.Macvlan)
+	if !ok {
+		return nil, errors.Errorf("%s is a %s link, not macvlan", info.IFName, link.Type())
+	}
+	if info.Mode, ok = modes[macvlan.Mode]; !ok {
+		return nil, errors.Errorf("unsupported macvlan mode %d of %s", macvlan.Mode, info.IFName)
+	}
+	return info, nil
+}
+
+func (_ *MacvlanNetwork) SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) error {
+	link := &netlink.Macvlan{Mode: netlink.MACVLAN_MODE_DEFAULT}
+	for mode, name := range modes {
+		if name == info.Mode {
+			link.Mode = mode
+		}
+	}
+	if link.Mode == netlink.MACVLAN_MODE_DEFAULT {
+		return errors.Errorf("unknown macvlan mode %q", info.Mode)
+	}
+	if err := generic.RestoreSubInterface(info, state, link); err != nil {
+		return err
+	}
+	log.Infof("[macvlan] restored %s on %s", info.IFName, info.Parent)
+	return nil
+}
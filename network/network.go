@@ -10,3 +10,13 @@ type Network interface {
 	ExtractNetworkInfo(conf *config.Config, state *specs.State) (*store.InterfaceInfo, error)
 	SimulateCNIAdd(info *store.InterfaceInfo, state *specs.State) error
 }
+
+// Recoverer is implemented by networks keeping state on the host side besides
+// the links, e.g. routes and sysctls, which can be lost while the container
+// keeps running.
+type Recoverer interface {
+	// HostIntact tells whether the host side of info is still in place.
+	HostIntact(info *store.InterfaceInfo) (bool, error)
+	// RecoverHost rebuilds the host side of info in place.
+	RecoverHost(info *store.InterfaceInfo, state *specs.State) error
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// RestoreError tells which step of restoring an interface failed, the steps
+// done before are undone already.
+type RestoreError struct {
+	IFName string
+	Step   string
+	Err    error
+}
+
+func (e *RestoreError) Error() string {
+	return fmt.Sprintf("failed to restore %s at step %q: %v", e.IFName, e.Step, e.Err)
+}
+
+func (e *RestoreError) Unwrap() error {
+	return e.Err
+}
+
+// Cause is for github.com/pkg/errors.
+func (e *RestoreError) Cause() error {
+	return e.Err
+}
+
+// Rollback runs the steps of restoring an interface, and remembers how to
+// undo them.
+type Rollback struct {
+	ifname string
+	undos  []undo
+}
+
+type undo struct {
+	step string
+	f    func() error
+}
+
+func NewRollback(ifname string) *Rollback {
+	return &Rollback{ifname: ifname}
+}
+
+// Step runs do, and records undo if it succeeds, undo can be nil if there is
+// nothing to revert, e.g. the step is reverted along with an earlier one.
+// The error is a *RestoreError, the innermost one is kept if do returns one.
+func (r *Rollback) Step(step string, do func() error, undoFunc func() error) error {
+	log.Debugf("[rollback] restoring %s: %s", r.ifname, step)
+	if err := do(); err != nil {
+		var restoreErr *RestoreError
+		if errors.As(err, &restoreErr) {
+			return restoreErr
+		}
+		return &RestoreError{IFName: r.ifname, Step: step, Err: err}
+	}
+	if undoFunc != nil {
+		r.undos = append(r.undos, undo{step: step, f: undoFunc})
+	}
+	return nil
+}
+
+// Undo reverts the recorded steps in reverse order, failures are only logged.
+func (r *Rollback) Undo() {
+	for i := len(r.undos) - 1; i >= 0; i-- {
+		log.Infof("[rollback] undoing %s of %s", r.undos[i].step, r.ifname)
+		if err := r.undos[i].f(); err != nil {
+			log.Errorf("[rollback] failed to undo %s of %s: %+v", r.undos[i].step, r.ifname, err)
+		}
+	}
+	r.undos = nil
+}
+
+// DeleteLink deletes the link in the netns, it's fine if it's gone already.
+// Deleting either end of a veth deletes both.
+func DeleteLink(netnsPath, name string) error {
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return errors.Wrapf(err, "failed to lookup %q", name)
+		}
+		return errors.Wrapf(netlink.LinkDel(link), "failed to delete %q", name)
+	})
+}
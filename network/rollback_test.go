@@ -0,0 +1,70 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollbackUndo(t *testing.T) {
+	r := NewRollback("eth0")
+	undone := []string{}
+	undoFunc := func(step string) func() error {
+		return func() error {
+			undone = append(undone, step)
+			return nil
+		}
+	}
+
+	require.NoError(t, r.Step("create veth", func() error { return nil }, undoFunc("create veth")))
+	require.NoError(t, r.Step("move veth", func() error { return nil }, nil))
+	require.NoError(t, r.Step("add address", func() error { return nil }, func() error {
+		undone = append(undone, "add address")
+		return errors.New("address is gone")
+	}))
+	require.NoError(t, r.Step("add route", func() error { return nil }, undoFunc("add route")))
+
+	// failed undos don't stop the others
+	r.Undo()
+	assert.Equal(t, []string{"add route", "add address", "create veth"}, undone)
+
+	// nothing is left to undo
+	undone = nil
+	r.Undo()
+	assert.Empty(t, undone)
+}
+
+func TestRollbackStep(t *testing.T) {
+	r := NewRollback("eth0")
+	undone := false
+	require.NoError(t, r.Step("create veth", func() error { return nil }, func() error {
+		undone = true
+		return nil
+	}))
+
+	cause := errors.New("file exists")
+	err := r.Step("add route", func() error { return cause }, func() error {
+		t.Fatal("the failed step is not undone")
+		return nil
+	})
+	restoreErr := &RestoreError{}
+	require.True(t, errors.As(err, &restoreErr))
+	assert.Equal(t, "eth0", restoreErr.IFName)
+	assert.Equal(t, "add route", restoreErr.Step)
+	assert.Equal(t, cause, errors.Cause(err))
+	assert.ErrorIs(t, err, cause)
+	assert.EqualError(t, err, `failed to restore eth0 at step "add route": file exists`)
+
+	// the innermost step is reported
+	inner := NewRollback("eth0")
+	err = r.Step("restore host side", func() error {
+		return inner.Step("enslave to bridge", func() error { return cause }, nil)
+	}, nil)
+	require.True(t, errors.As(err, &restoreErr))
+	assert.Equal(t, "enslave to bridge", restoreErr.Step)
+
+	r.Undo()
+	assert.True(t, undone)
+}
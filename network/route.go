@@ -0,0 +1,109 @@
+package network
+
+import (
+	"net"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ListRoutes returns the routes through link in all tables but the local one.
+// Kernel routes are skipped since they come back along with the addresses.
+func ListRoutes(link netlink.Link) ([]store.Route, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     unix.RT_TABLE_UNSPEC,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get routes of %s", link.Attrs().Name)
+	}
+	result := []store.Route{}
+	for _, r := range routes {
+		if r.Table == unix.RT_TABLE_LOCAL || r.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		result = append(result, RouteFromNetlink(r))
+	}
+	return result, nil
+}
+
+// AddRoutes replays routes onto link, link scoped routes go first so the
+// gateways of the others are reachable.
+func AddRoutes(link netlink.Link, routes []store.Route) error {
+	nlRoutes := []*netlink.Route{}
+	for _, r := range routes {
+		route, err := RouteToNetlink(r, link.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		nlRoutes = append(nlRoutes, route)
+	}
+	sort.SliceStable(nlRoutes, func(i, j int) bool { return nlRoutes[i].Scope > nlRoutes[j].Scope })
+	for _, route := range nlRoutes {
+		if err := netlink.RouteReplace(route); err != nil {
+			return errors.Wrapf(err, "failed to add route %s", route)
+		}
+		log.Debugf("[network] restored route %s on %s", route, link.Attrs().Name)
+	}
+	return nil
+}
+
+func RouteFromNetlink(r netlink.Route) store.Route {
+	route := store.Route{
+		Scope:    int(r.Scope),
+		Table:    r.Table,
+		Metric:   r.Priority,
+		Protocol: int(r.Protocol),
+		MTU:      r.MTU,
+		OnLink:   r.Flags&int(netlink.FLAG_ONLINK) != 0,
+	}
+	switch {
+	case r.Dst != nil:
+		route.Dst = r.Dst.String()
+	case r.Family == netlink.FAMILY_V6:
+		route.Dst = "::/0"
+	default:
+		route.Dst = "0.0.0.0/0"
+	}
+	if r.Gw != nil {
+		route.Gw = r.Gw.String()
+	}
+	if r.Src != nil {
+		route.Src = r.Src.String()
+	}
+	return route
+}
+
+func RouteToNetlink(r store.Route, linkIndex int) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid route destination %q", r.Dst)
+	}
+	route := &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       dst,
+		Scope:     netlink.Scope(r.Scope),
+		Table:     r.Table,
+		Priority:  r.Metric,
+		Protocol:  netlink.RouteProtocol(r.Protocol),
+		MTU:       r.MTU,
+	}
+	if r.Gw != "" {
+		if route.Gw = net.ParseIP(r.Gw); route.Gw == nil {
+			return nil, errors.Errorf("invalid route gateway %q", r.Gw)
+		}
+	}
+	if r.Src != "" {
+		if route.Src = net.ParseIP(r.Src); route.Src == nil {
+			return nil, errors.Errorf("invalid route source %q", r.Src)
+		}
+	}
+	if r.OnLink {
+		route.SetFlag(netlink.FLAG_ONLINK)
+	}
+	return route, nil
+}
@@ -0,0 +1,136 @@
+package oci
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PortMapping is the entry of the portMappings capability.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// Bandwidth is the bandwidth capability, rates in bits per second and bursts in bits.
+type Bandwidth struct {
+	IngressRate  int `json:"ingressRate,omitempty"`
+	IngressBurst int `json:"ingressBurst,omitempty"`
+	EgressRate   int `json:"egressRate,omitempty"`
+	EgressBurst  int `json:"egressBurst,omitempty"`
+}
+
+// DNS is the dns capability.
+type DNS struct {
+	Servers  []string `json:"servers,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// CapabilityArgs derives the CNI runtime capability args from the container
+// env and annotations, the annotation wins if both are set:
+//
+//	portMappings: PUBLISH, see PublishedPorts, plus org.projecteru2.cni.port-mappings annotation in JSON,
+//	              tcp if the protocol is omitted
+//	bandwidth:    INGRESS_RATE, INGRESS_BURST, EGRESS_RATE, EGRESS_BURST
+//	ips:          IPS, comma separated
+//	mac:          MAC
+//	dns:          DNS_SERVERS, DNS_SEARCHES, DNS_OPTIONS, comma separated
+func (c ContainerMeta) CapabilityArgs() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+
+	portMappings, err := c.PublishedPorts()
+	if err != nil {
+		return nil, err
+	}
+	if v := c.Annotations["org.projecteru2.cni.port-mappings"]; v != "" {
+		extra := []PortMapping{}
+		if err := json.Unmarshal([]byte(v), &extra); err != nil {
+			return nil, errors.Wrapf(err, "invalid port mappings %q", v)
+		}
+		for i := range extra {
+			// tcp by default, as PUBLISH
+			if extra[i].Protocol == "" {
+				extra[i].Protocol = "tcp"
+			}
+			extra[i].Protocol = strings.ToLower(extra[i].Protocol)
+		}
+		portMappings = append(portMappings, extra...)
+	}
+	if err = validatePortMappings(portMappings); err != nil {
+		return nil, err
+	}
+	if len(portMappings) != 0 {
+		args["portMappings"] = portMappings
+	}
+
+	bandwidth := Bandwidth{}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"INGRESS_RATE", &bandwidth.IngressRate},
+		{"INGRESS_BURST", &bandwidth.IngressBurst},
+		{"EGRESS_RATE", &bandwidth.EgressRate},
+		{"EGRESS_BURST", &bandwidth.EgressBurst},
+	} {
+		v := c.lookup(field.name, "org.projecteru2.cni."+annotationName(field.name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s %q", field.name, v)
+		}
+		*field.value = n
+	}
+	if bandwidth != (Bandwidth{}) {
+		args["bandwidth"] = bandwidth
+	}
+
+	if ips := splitList(c.lookup("IPS", "org.projecteru2.cni.ips")); len(ips) != 0 {
+		for _, ip := range ips {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				return nil, errors.Errorf("invalid ip %q", ip)
+			}
+		}
+		args["ips"] = ips
+	}
+
+	if mac := c.lookup("MAC", "org.projecteru2.cni.mac"); mac != "" {
+		if _, err := net.ParseMAC(mac); err != nil {
+			return nil, errors.Wrapf(err, "invalid mac %q", mac)
+		}
+		args["mac"] = mac
+	}
+
+	dns := DNS{
+		Servers:  splitList(c.lookup("DNS_SERVERS", "org.projecteru2.cni.dns-servers")),
+		Searches: splitList(c.lookup("DNS_SEARCHES", "org.projecteru2.cni.dns-searches")),
+		Options:  splitList(c.lookup("DNS_OPTIONS", "org.projecteru2.cni.dns-options")),
+	}
+	if len(dns.Servers)+len(dns.Searches)+len(dns.Options) != 0 {
+		args["dns"] = dns
+	}
+	return args, nil
+}
+
+// annotationName turns INGRESS_RATE into ingress-rate.
+func annotationName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
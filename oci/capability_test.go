@@ -0,0 +1,77 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func containerMeta(env []string, annotations map[string]string) ContainerMeta {
+	return ContainerMeta{Spec: specs.Spec{Process: &specs.Process{Env: env}, Annotations: annotations}}
+}
+
+func TestCapabilityArgs(t *testing.T) {
+	args, err := containerMeta(nil, nil).CapabilityArgs()
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+
+	c := containerMeta(
+		[]string{"PUBLISH=8080:80", "INGRESS_RATE=1000", "EGRESS_BURST=200", "IPS=10.0.0.2/24, 10.0.1.2", "MAC=ee:ee:ee:ee:ee:ee", "DNS_SERVERS=1.1.1.1,8.8.8.8", "DNS_SEARCHES=local"},
+		map[string]string{"org.projecteru2.cni.port-mappings": `[{"hostPort":53,"containerPort":53,"protocol":"UDP"},{"hostPort":9090,"containerPort":90}]`},
+	)
+	args, err = c.CapabilityArgs()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"portMappings": []PortMapping{
+			{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+			{HostPort: 53, ContainerPort: 53, Protocol: "udp"},
+			{HostPort: 9090, ContainerPort: 90, Protocol: "tcp"},
+		},
+		"bandwidth": Bandwidth{IngressRate: 1000, EgressBurst: 200},
+		"ips":       []string{"10.0.0.2/24", "10.0.1.2"},
+		"mac":       "ee:ee:ee:ee:ee:ee",
+		"dns":       DNS{Servers: []string{"1.1.1.1", "8.8.8.8"}, Searches: []string{"local"}, Options: []string{}},
+	}, args)
+}
+
+func TestCapabilityArgsAnnotationWins(t *testing.T) {
+	c := containerMeta(
+		[]string{"PUBLISH=8080:80", "INGRESS_RATE=1000", "IPS=10.0.0.2", "MAC=ee:ee:ee:ee:ee:ee"},
+		map[string]string{
+			"org.projecteru2.cni.publish":      "8081:81",
+			"org.projecteru2.cni.ingress-rate": "2000",
+			"org.projecteru2.cni.ips":          "10.0.0.3",
+			"org.projecteru2.cni.mac":          "ee:ee:ee:ee:ee:ef",
+		},
+	)
+	args, err := c.CapabilityArgs()
+	require.NoError(t, err)
+	assert.Equal(t, []PortMapping{{HostPort: 8081, ContainerPort: 81, Protocol: "tcp"}}, args["portMappings"])
+	assert.Equal(t, Bandwidth{IngressRate: 2000}, args["bandwidth"])
+	assert.Equal(t, []string{"10.0.0.3"}, args["ips"])
+	assert.Equal(t, "ee:ee:ee:ee:ee:ef", args["mac"])
+}
+
+func TestCapabilityArgsInvalid(t *testing.T) {
+	cases := []struct {
+		env         []string
+		annotations map[string]string
+		err         string
+	}{
+		{[]string{"INGRESS_RATE=fast"}, nil, "invalid INGRESS_RATE"},
+		{[]string{"EGRESS_BURST=-1"}, nil, "invalid EGRESS_BURST"},
+		{[]string{"IPS=10.0.0.2,10.0.0"}, nil, `invalid ip "10.0.0"`},
+		{[]string{"MAC=ee:ee"}, nil, "invalid mac"},
+		{[]string{"PUBLISH=80"}, nil, "host port is required"},
+		{nil, map[string]string{"org.projecteru2.cni.port-mappings": `{"hostPort":80}`}, "invalid port mappings"},
+		{nil, map[string]string{"org.projecteru2.cni.port-mappings": `[{"hostPort":80,"containerPort":80,"protocol":"icmp"}]`}, "invalid protocol"},
+		// merged with PUBLISH before validated
+		{[]string{"PUBLISH=8080:80"}, map[string]string{"org.projecteru2.cni.port-mappings": `[{"hostPort":8080,"containerPort":81}]`}, "published more than once"},
+	}
+	for _, c := range cases {
+		_, err := containerMeta(c.env, c.annotations).CapabilityArgs()
+		assert.ErrorContains(t, err, c.err, "%v %v", c.env, c.annotations)
+	}
+}
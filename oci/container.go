@@ -61,3 +61,43 @@ func (c ContainerMeta) SpecificIPPool() string {
 func (c ContainerMeta) RequiresSpecificIPPool() bool {
 	return c.SpecificIPPool() != ""
 }
+
+// IPKey is what the network of the container is reserved by, see ip_identity.
+func (c ContainerMeta) IPKey() string {
+	return c.lookup("IP_KEY", "org.projecteru2.cni.ip-key")
+}
+
+// lookup returns the value of the annotation if set, otherwise the value of env in the container process.
+func (c ContainerMeta) lookup(env, annotation string) string {
+	if v := c.Annotations[annotation]; v != "" {
+		return v
+	}
+	if c.Process == nil {
+		return ""
+	}
+	for _, e := range c.Process.Env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 && parts[0] == env && parts[1] != "" {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// SpecificNetwork returns the name of the single network the container attaches to.
+func (c ContainerMeta) SpecificNetwork() string {
+	return c.lookup("CNI_NETWORK", "org.projecteru2.cni.network")
+}
+
+func (c ContainerMeta) RequiresSpecificNetwork() bool {
+	return c.SpecificNetwork() != ""
+}
+
+// SpecificNetworks returns the "network[:ifname],..." list the container attaches to.
+func (c ContainerMeta) SpecificNetworks() string {
+	return c.lookup("CNI_NETWORKS", "org.projecteru2.cni.networks")
+}
+
+func (c ContainerMeta) RequiresSpecificNetworks() bool {
+	return c.SpecificNetworks() != ""
+}
@@ -0,0 +1,58 @@
+package oci
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	ResolvConfFilename = "cni-resolv.conf"
+	HostsFilename      = "cni-hosts"
+)
+
+// BindDNSFiles binds resolv.conf and hosts in the bundle into the container,
+// so the prestart hook can render them in place.
+// They are seeded with what docker prepared, in case the hook has nothing to render.
+func (c *ContainerMeta) BindDNSFiles() error {
+	bundleDir := path.Dir(c.BundlePath)
+	for _, file := range []struct{ destination, filename string }{
+		{"/etc/resolv.conf", ResolvConfFilename},
+		{"/etc/hosts", HostsFilename},
+	} {
+		source := path.Join(bundleDir, file.filename)
+		idx := -1
+		for i, m := range c.Mounts {
+			if m.Destination == file.destination {
+				idx = i
+			}
+		}
+
+		content := []byte{}
+		if idx >= 0 {
+			data, err := ioutil.ReadFile(c.Mounts[idx].Source)
+			if err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+			content = data
+		}
+		if err := ioutil.WriteFile(source, content, 0644); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if idx >= 0 {
+			c.Mounts[idx].Source = source
+			continue
+		}
+		c.Mounts = append(c.Mounts, specs.Mount{
+			Destination: file.destination,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", "rprivate"},
+		})
+	}
+	return nil
+}
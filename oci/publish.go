@@ -0,0 +1,99 @@
+package oci
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PublishedPorts parses the docker style "[hostIP:]hostPort:containerPort[/protocol]"
+// bindings in the comma separated PUBLISH env or org.projecteru2.cni.publish annotation.
+func (c ContainerMeta) PublishedPorts() ([]PortMapping, error) {
+	portMappings := []PortMapping{}
+	for _, binding := range splitList(c.lookup("PUBLISH", "org.projecteru2.cni.publish")) {
+		portMapping, err := parsePortBinding(binding)
+		if err != nil {
+			return nil, err
+		}
+		portMappings = append(portMappings, portMapping)
+	}
+	return portMappings, nil
+}
+
+func parsePortBinding(binding string) (portMapping PortMapping, err error) {
+	portMapping.Protocol = "tcp"
+	spec := binding
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		spec, portMapping.Protocol = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	switch portMapping.Protocol {
+	case "tcp", "udp", "sctp":
+	default:
+		return portMapping, errors.Errorf("invalid protocol in port binding %q", binding)
+	}
+
+	// the host ip may be an IPv6 address in brackets, split the ports from the right
+	i := strings.LastIndex(spec, ":")
+	if i == -1 {
+		return portMapping, errors.Errorf("host port is required in port binding %q", binding)
+	}
+	hostPart, containerPort := spec[:i], spec[i+1:]
+	hostPort := hostPart
+	if j := strings.LastIndex(hostPart, ":"); j != -1 {
+		hostIP := strings.TrimSuffix(strings.TrimPrefix(hostPart[:j], "["), "]")
+		if net.ParseIP(hostIP) == nil {
+			return portMapping, errors.Errorf("invalid host ip in port binding %q", binding)
+		}
+		portMapping.HostIP, hostPort = hostIP, hostPart[j+1:]
+	}
+
+	if portMapping.HostPort, err = parsePort(hostPort); err != nil {
+		return portMapping, errors.Wrapf(err, "invalid host port in port binding %q", binding)
+	}
+	if portMapping.ContainerPort, err = parsePort(containerPort); err != nil {
+		return portMapping, errors.Wrapf(err, "invalid container port in port binding %q", binding)
+	}
+	return portMapping, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if port < 1 || port > 65535 {
+		return 0, errors.Errorf("port %d out of range", port)
+	}
+	return port, nil
+}
+
+// validatePortMappings rejects invalid mappings and the ones binding the same
+// host port twice, a mapping on all addresses takes the port of every address.
+func validatePortMappings(portMappings []PortMapping) error {
+	seen := map[string][]string{} // protocol/port -> host ips, empty for all
+	for _, pm := range portMappings {
+		if pm.HostPort < 1 || pm.HostPort > 65535 || pm.ContainerPort < 1 || pm.ContainerPort > 65535 {
+			return errors.Errorf("port mapping %d:%d out of range", pm.HostPort, pm.ContainerPort)
+		}
+		switch pm.Protocol {
+		case "tcp", "udp", "sctp":
+		default:
+			return errors.Errorf("invalid protocol %q in port mapping %d:%d", pm.Protocol, pm.HostPort, pm.ContainerPort)
+		}
+		hostIP := pm.HostIP
+		if ip := net.ParseIP(hostIP); ip == nil || ip.IsUnspecified() {
+			hostIP = ""
+		}
+		key := fmt.Sprintf("%s/%d", pm.Protocol, pm.HostPort)
+		for _, ip := range seen[key] {
+			if ip == hostIP || ip == "" || hostIP == "" {
+				return errors.Errorf("host port %d/%s is published more than once", pm.HostPort, pm.Protocol)
+			}
+		}
+		seen[key] = append(seen[key], hostIP)
+	}
+	return nil
+}
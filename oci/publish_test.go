@@ -0,0 +1,64 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortBinding(t *testing.T) {
+	cases := []struct {
+		binding  string
+		expected PortMapping
+		err      string
+	}{
+		{"8080:80", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}, ""},
+		{"1.2.3.4:8080:80/udp", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "udp", HostIP: "1.2.3.4"}, ""},
+		{"[::1]:8080:80", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "::1"}, ""},
+		{"8080:80/SCTP", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "sctp"}, ""},
+		{"80", PortMapping{}, "host port is required"},
+		{"1.2.3.4::80", PortMapping{}, "invalid host port"},
+		{"70000:80", PortMapping{}, "invalid host port"},
+		{"8080:0", PortMapping{}, "invalid container port"},
+		{"8080:80/icmp", PortMapping{}, "invalid protocol"},
+		{"1.2.3:8080:80", PortMapping{}, "invalid host ip"},
+	}
+	for _, c := range cases {
+		portMapping, err := parsePortBinding(c.binding)
+		if c.err != "" {
+			assert.ErrorContains(t, err, c.err, c.binding)
+			continue
+		}
+		if assert.NoError(t, err, c.binding) {
+			assert.Equal(t, c.expected, portMapping, c.binding)
+		}
+	}
+}
+
+func TestValidatePortMappings(t *testing.T) {
+	tcp := func(hostIP string, hostPort int) PortMapping {
+		return PortMapping{HostIP: hostIP, HostPort: hostPort, ContainerPort: 80, Protocol: "tcp"}
+	}
+	cases := []struct {
+		name         string
+		portMappings []PortMapping
+		err          string
+	}{
+		{"distinct", []PortMapping{tcp("", 8080), tcp("", 8081), {HostPort: 8080, ContainerPort: 80, Protocol: "udp"}}, ""},
+		{"distinct host ips", []PortMapping{tcp("1.2.3.4", 8080), tcp("1.2.3.5", 8080)}, ""},
+		{"duplicate", []PortMapping{tcp("", 8080), tcp("", 8080)}, "published more than once"},
+		{"duplicate host ip", []PortMapping{tcp("1.2.3.4", 8080), tcp("1.2.3.4", 8080)}, "published more than once"},
+		{"wildcard first", []PortMapping{tcp("0.0.0.0", 8080), tcp("1.2.3.4", 8080)}, "published more than once"},
+		{"wildcard last", []PortMapping{tcp("1.2.3.4", 8080), tcp("", 8080)}, "published more than once"},
+		{"out of range", []PortMapping{tcp("", 65536)}, "out of range"},
+		{"bad protocol", []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}}, "invalid protocol"},
+	}
+	for _, c := range cases {
+		err := validatePortMappings(c.portMappings)
+		if c.err == "" {
+			assert.NoError(t, err, c.name)
+		} else {
+			assert.ErrorContains(t, err, c.err, c.name)
+		}
+	}
+}
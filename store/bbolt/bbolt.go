@@ -1,6 +1,7 @@
 package bbolt
 
 import (
+	"bytes"
 	"encoding/json"
 	"time"
 
@@ -13,8 +14,11 @@ import (
 )
 
 const (
-	stateBucketName     = "docker-cni-state"
-	addOutputBucketName = "docker-cni-add-output"
+	stateBucketName       = "docker-cni-state"
+	addOutputBucketName   = "docker-cni-add-output"
+	cniResultBucketName   = "docker-cni-result"
+	reservationBucketName = "docker-cni-reservation"
+	releaseBucketName     = "docker-cni-release"
 )
 
 type Store struct {
@@ -30,10 +34,23 @@ func New(conf config.Config) *Store {
 	return store
 }
 
+// Open opens the db and migrates it to the latest schema version.
 func (s *Store) Open() error {
 	if s.db != nil {
 		return nil // Already opened
 	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if _, err := s.migrate(false); err != nil {
+		s.db.Close()
+		s.db = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Store) open() error {
 	conf := &s.conf
 	var err error
 
@@ -49,38 +66,143 @@ func (s *Store) Close() error {
 }
 
 func (s *Store) PutInterfaceInfo(key string, info *store.InterfaceInfo) error {
-	infoBuf, err := json.Marshal(info)
-	if err != nil {
-		return errors.WithStack(err)
-	}
 	return s.db.Update(func(tx *bolt.Tx) error {
 		var err error
 		b, err := tx.CreateBucketIfNotExists([]byte(addOutputBucketName))
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		infos, err := decodeInterfaceInfos(b.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		replaced := false
+		for i, old := range infos {
+			if old.IFName == info.IFName {
+				infos[i], replaced = info, true
+			}
+		}
+		if !replaced {
+			infos = append(infos, info)
+		}
+		infoBuf, err := json.Marshal(infos)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		return b.Put([]byte(key), infoBuf)
 	})
 }
 
 func (s *Store) GetInterfaceInfo(key string) (*store.InterfaceInfo, error) {
-	var info *store.InterfaceInfo
+	infos, err := s.ListInterfaceInfo(key)
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+func (s *Store) ListInterfaceInfo(key string) ([]*store.InterfaceInfo, error) {
+	var infos []*store.InterfaceInfo
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(addOutputBucketName))
 		if b == nil {
 			return nil // No results found
 		}
-		infoBytes := b.Get([]byte(key))
-		if len(infoBytes) == 0 {
+		var err error
+		infos, err = decodeInterfaceInfos(b.Get([]byte(key)))
+		return err
+	})
+	return infos, errors.WithStack(err)
+}
+
+// decodeInterfaceInfos also accepts the single object written by older versions.
+func decodeInterfaceInfos(data []byte) ([]*store.InterfaceInfo, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[0] == '{' {
+		info := &store.InterfaceInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return []*store.InterfaceInfo{info}, nil
+	}
+	infos := []*store.InterfaceInfo{}
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return infos, nil
+}
+
+func (s *Store) PutCNIResult(id, ifname string, result []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(cniResultBucketName))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// one sub bucket per container, keyed by interface name
+		cb, err := b.CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return cb.Put([]byte(ifname), result)
+	})
+}
+
+func (s *Store) GetCNIResult(id, ifname string) ([]byte, error) {
+	var result []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(cniResultBucketName))
+		if b == nil {
+			return nil
+		}
+		cb := b.Bucket([]byte(id))
+		if cb == nil {
+			return nil
+		}
+		if v := cb.Get([]byte(ifname)); v != nil {
+			// the value is only valid during the transaction
+			result = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return result, errors.WithStack(err)
+}
+
+func (s *Store) DeleteCNIResults(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(cniResultBucketName))
+		if b == nil {
 			return nil
 		}
-		info = &store.InterfaceInfo{}
-		if err := json.Unmarshal(infoBytes, info); err != nil {
+		if err := b.DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
 			return errors.WithStack(err)
 		}
 		return nil
 	})
-	return info, errors.WithStack(err)
+}
+
+func (s *Store) ListCNIResults(id string) (map[string][]byte, error) {
+	results := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(cniResultBucketName))
+		if b == nil {
+			return nil
+		}
+		cb := b.Bucket([]byte(id))
+		if cb == nil {
+			return nil
+		}
+		return cb.ForEach(func(k, v []byte) error {
+			results[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return results, nil
 }
 
 func (s *Store) PutContainerState(id string, state *specs.State) error {
@@ -118,40 +240,214 @@ func (s *Store) GetContainerState(id string) (*specs.State, error) {
 	return state, nil
 }
 
-func (s *Store) DeleteContiners(existContainerIDs map[string]struct{}) (map[string]specs.State, error) {
-	var err error
-	deleteMap := make(map[string]specs.State)
-	if err = s.db.Update(func(tx *bolt.Tx) error {
-		b1 := tx.Bucket([]byte(stateBucketName))
-		if b1 == nil {
+func (s *Store) ListContainerStates() (map[string]specs.State, error) {
+	states := make(map[string]specs.State)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucketName))
+		if b == nil {
 			return nil
 		}
-		b2 := tx.Bucket([]byte(addOutputBucketName))
-		if b2 == nil {
+		return b.ForEach(func(k, v []byte) error {
+			var state specs.State
+			if err := json.Unmarshal(v, &state); err != nil {
+				return errors.WithStack(err)
+			}
+			states[string(k)] = state
 			return nil
-		}
+		})
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return states, nil
+}
 
-		cursor := b1.Cursor()
-		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			// Delete key if container no longer exists
-			if _, exists := existContainerIDs[string(k)]; !exists {
-				if err := b1.Delete(k); err != nil {
-					return err
-				}
-				if err := b2.Delete(k); err != nil {
+func (s *Store) ForEachContainer(fn func(id string, state *specs.State, infos []*store.InterfaceInfo) error) error {
+	type container struct {
+		id    string
+		state *specs.State
+		infos []*store.InterfaceInfo
+	}
+	// read them all first, fn can't touch the store within the transaction
+	containers := []container{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucketName))
+		if b == nil {
+			return nil
+		}
+		infoBucket := tx.Bucket([]byte(addOutputBucketName))
+		return b.ForEach(func(k, v []byte) error {
+			c := container{id: string(k), state: &specs.State{}}
+			if err := json.Unmarshal(v, c.state); err != nil {
+				return errors.WithStack(err)
+			}
+			if infoBucket != nil {
+				var err error
+				if c.infos, err = decodeInterfaceInfos(infoBucket.Get(k)); err != nil {
 					return err
 				}
+			}
+			containers = append(containers, c)
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, c := range containers {
+		if err = fn(c.id, c.state, c.infos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) PutReservation(reservation *store.Reservation) error {
+	buf, err := json.Marshal(reservation)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(reservationBucketName))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return b.Put([]byte(reservation.Key), buf)
+	})
+}
+
+func (s *Store) GetReservation(key string) (*store.Reservation, error) {
+	var reservation *store.Reservation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(reservationBucketName))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get([]byte(key))
+		if buf == nil {
+			return nil
+		}
+		reservation = &store.Reservation{}
+		return json.Unmarshal(buf, reservation)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return reservation, nil
+}
+
+func (s *Store) ListReservations() ([]*store.Reservation, error) {
+	reservations := []*store.Reservation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(reservationBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			reservation := &store.Reservation{}
+			if err := json.Unmarshal(v, reservation); err != nil {
+				return errors.WithStack(err)
+			}
+			reservations = append(reservations, reservation)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return reservations, nil
+}
+
+func (s *Store) DeleteReservation(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(reservationBucketName))
+		if b == nil {
+			return nil
+		}
+		return errors.WithStack(b.Delete([]byte(key)))
+	})
+}
 
-				var state specs.State
-				if err = json.Unmarshal(v, &state); err != nil {
+func (s *Store) DeleteContainer(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{stateBucketName, addOutputBucketName, releaseBucketName} {
+			if b := tx.Bucket([]byte(name)); b != nil {
+				if err := b.Delete([]byte(id)); err != nil {
 					return errors.WithStack(err)
 				}
-				deleteMap[string(k)] = state
+			}
+		}
+		if b := tx.Bucket([]byte(cniResultBucketName)); b != nil {
+			if err := b.DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+				return errors.WithStack(err)
 			}
 		}
 		return nil
-	}); err != nil {
+	})
+}
+
+func (s *Store) PutRelease(release *store.Release) error {
+	buf, err := json.Marshal(release)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(releaseBucketName))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return b.Put([]byte(release.ContainerID), buf)
+	})
+}
+
+func (s *Store) GetRelease(id string) (*store.Release, error) {
+	var release *store.Release
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(releaseBucketName))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		release = &store.Release{}
+		return json.Unmarshal(buf, release)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return release, nil
+}
+
+func (s *Store) ListReleases() ([]*store.Release, error) {
+	releases := []*store.Release{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(releaseBucketName))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			release := &store.Release{}
+			if err := json.Unmarshal(v, release); err != nil {
+				return errors.WithStack(err)
+			}
+			releases = append(releases, release)
+			return nil
+		})
+	})
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return deleteMap, nil
+	return releases, nil
+}
+
+func (s *Store) DeleteRelease(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(releaseBucketName))
+		if b == nil {
+			return nil
+		}
+		return errors.WithStack(b.Delete([]byte(id)))
+	})
 }
@@ -0,0 +1,181 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	metaBucketName   = "docker-cni-meta"
+	schemaVersionKey = "schema_version"
+)
+
+// Migration upgrades the schema from Version-1 to Version.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+
+	migrate func(tx *bolt.Tx) error
+}
+
+// migrations are applied in order, the schema version of a db written before
+// versioning is 0. Never change or drop a released migration, append a new one.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "store the interfaces of a container as a list, with structured routes",
+		migrate:     migrateInterfaceInfoList,
+	},
+}
+
+// LatestSchemaVersion is the schema version this build writes.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationReport is what Migrate did, or would do with dry run.
+type MigrationReport struct {
+	DryRun     bool        `json:"dry_run"`
+	From       int         `json:"from"`
+	To         int         `json:"to"`
+	Migrations []Migration `json:"migrations"`
+	Backup     string      `json:"backup,omitempty"` // copy of the db file taken before migrating
+}
+
+// Migrate upgrades the db of conf to the latest schema version, which Open
+// does as well, or only reports what would be done with dry run.
+func Migrate(conf config.Config, dryRun bool) (*MigrationReport, error) {
+	s := New(conf)
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.migrate(dryRun)
+}
+
+// migrate copies the db file aside before migrating. All the migrations run in
+// one transaction, so the db is either fully migrated or untouched. A new db
+// is stamped with the latest version.
+func (s *Store) migrate(dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, To: LatestSchemaVersion(), Migrations: []Migration{}}
+	fresh := false
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		if report.From, err = schemaVersion(tx); err != nil {
+			return err
+		}
+		fresh = isEmpty(tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report.From > report.To {
+		return nil, errors.Errorf("schema version %d of %s is newer than %d supported, upgrade docker-cni", report.From, s.conf.StoreFile, report.To)
+	}
+	for _, m := range migrations {
+		if m.Version > report.From {
+			report.Migrations = append(report.Migrations, m)
+		}
+	}
+	if dryRun || report.From == report.To {
+		return report, nil
+	}
+
+	if !fresh {
+		report.Backup = fmt.Sprintf("%s.v%d.%s.bak", s.conf.StoreFile, report.From, time.Now().Format("20060102150405"))
+		if err = s.db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(report.Backup, 0600)
+		}); err != nil {
+			return nil, errors.Wrapf(err, "failed to back up %s", s.conf.StoreFile)
+		}
+		log.Infof("[store] backed up %s to %s", s.conf.StoreFile, report.Backup)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range report.Migrations {
+			// nothing to convert in a new db
+			if !fresh {
+				log.Infof("[store] migrating to schema version %d: %s", m.Version, m.Description)
+				if err := m.migrate(tx); err != nil {
+					return errors.Wrapf(err, "failed to migrate to schema version %d", m.Version)
+				}
+			}
+		}
+		return setSchemaVersion(tx, report.To)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return report, nil
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(metaBucketName))
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get([]byte(schemaVersionKey))
+	if v == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(v))
+	return version, errors.Wrapf(err, "invalid schema version %q", v)
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(b.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(version))))
+}
+
+// isEmpty tells if nothing but the meta bucket is there.
+func isEmpty(tx *bolt.Tx) bool {
+	c := tx.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if string(k) != metaBucketName {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateInterfaceInfoList rewrites the single objects and legacy route
+// strings written by older versions.
+func migrateInterfaceInfoList(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(addOutputBucketName))
+	if b == nil {
+		return nil
+	}
+	updates := map[string][]byte{}
+	if err := b.ForEach(func(k, v []byte) error {
+		infos, err := decodeInterfaceInfos(v)
+		if err != nil {
+			return errors.Wrapf(err, "invalid interface info of %s", k)
+		}
+		if infos == nil {
+			return nil
+		}
+		if updates[string(k)], err = json.Marshal(infos); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	// modifying the bucket within ForEach is not allowed
+	for k, v := range updates {
+		if err := b.Put([]byte(k), v); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeRawDB writes values into buckets of a db file, as older versions did.
+func writeRawDB(t *testing.T, path string, buckets map[string]map[string]string) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		for name, values := range buckets {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range values {
+				if err = b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}))
+}
+
+func readRawValue(t *testing.T, path, bucket, key string) (value []byte) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			value = append([]byte{}, b.Get([]byte(key))...)
+		}
+		return nil
+	}))
+	return value
+}
+
+func dbSchemaVersion(t *testing.T, s *Store) (version int) {
+	require.NoError(t, s.db.View(func(tx *bolt.Tx) (err error) {
+		version, err = schemaVersion(tx)
+		return err
+	}))
+	return version
+}
+
+func TestMigrateNewDB(t *testing.T) {
+	s, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	// a new db is stamped without backup
+	assert.Equal(t, LatestSchemaVersion(), dbSchemaVersion(t, s))
+	backups, err := filepath.Glob(s.conf.StoreFile + ".*.bak")
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	// reopening it migrates nothing
+	require.NoError(t, s.Close())
+	report, err := Migrate(s.conf, false)
+	require.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion(), report.From)
+	assert.Empty(t, report.Migrations)
+	assert.Empty(t, report.Backup)
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	conf := config.Config{StoreFile: filepath.Join(t.TempDir(), "test.db")}
+	legacy := `{"ifname":"eth0","ips":["10.0.0.2/32"],"routes":["dst=default via=169.254.1.1"]}`
+	writeRawDB(t, conf.StoreFile, map[string]map[string]string{
+		stateBucketName:     {"container1": `{"id":"container1","status":"running"}`},
+		addOutputBucketName: {"container1": legacy},
+	})
+
+	// dry run only reports
+	report, err := Migrate(conf, true)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 0, report.From)
+	assert.Equal(t, LatestSchemaVersion(), report.To)
+	assert.Len(t, report.Migrations, LatestSchemaVersion())
+	assert.Empty(t, report.Backup)
+	assert.Equal(t, legacy, string(readRawValue(t, conf.StoreFile, addOutputBucketName, "container1")))
+
+	// Open migrates
+	s := New(conf)
+	require.NoError(t, s.Open())
+	defer s.Close()
+	assert.Equal(t, LatestSchemaVersion(), dbSchemaVersion(t, s))
+
+	infos, err := s.ListInterfaceInfo("container1")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, []store.Route{{Dst: "0.0.0.0/0", Gw: "169.254.1.1"}}, infos[0].Routes)
+	require.NoError(t, s.Close())
+
+	raw := []map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(readRawValue(t, conf.StoreFile, addOutputBucketName, "container1"), &raw))
+	require.Len(t, raw, 1)
+	assert.Equal(t, "0.0.0.0/0", raw[0]["routes"].([]interface{})[0].(map[string]interface{})["dst"])
+
+	// the backup is the db before migrating
+	backups, err := filepath.Glob(conf.StoreFile + ".v0.*.bak")
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, legacy, string(readRawValue(t, backups[0], addOutputBucketName, "container1")))
+}
+
+func TestMigrateNewerDB(t *testing.T) {
+	conf := config.Config{StoreFile: filepath.Join(t.TempDir(), "test.db")}
+	writeRawDB(t, conf.StoreFile, map[string]map[string]string{
+		metaBucketName: {schemaVersionKey: "1000"},
+	})
+
+	s := New(conf)
+	assert.Error(t, s.Open())
+	assert.Nil(t, s.db)
+	_, err := Migrate(conf, true)
+	assert.Error(t, err)
+
+	// the db is closed, so the lock is released
+	writeRawDB(t, conf.StoreFile, nil)
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// DumpVersion is the version of the Dump format this build reads and writes.
+const DumpVersion = 1
+
+// Dump is all the records of a store, in a format independent of the backend.
+type Dump struct {
+	Version      int                `json:"version"`
+	Host         string             `json:"host,omitempty"` // where it's exported
+	ExportedAt   time.Time          `json:"exported_at"`
+	Containers   []*DumpedContainer `json:"containers"`
+	Reservations []*Reservation     `json:"reservations"`
+	Releases     []*Release         `json:"releases"`
+}
+
+// DumpedContainer is a container with everything stored under its ID.
+type DumpedContainer struct {
+	ID         string                     `json:"id"`
+	State      specs.State                `json:"state"`
+	Interfaces []*InterfaceInfo           `json:"interfaces"`
+	CNIResults map[string]json.RawMessage `json:"cni_results,omitempty"` // by interface name
+}
+
+// Export dumps all the records of s.
+func Export(s Store) (*Dump, error) {
+	host, _ := os.Hostname()
+	dump := &Dump{
+		Version:    DumpVersion,
+		Host:       host,
+		ExportedAt: time.Now(),
+		Containers: []*DumpedContainer{},
+	}
+	err := s.ForEachContainer(func(id string, state *specs.State, infos []*InterfaceInfo) error {
+		results, err := s.ListCNIResults(id)
+		if err != nil {
+			return err
+		}
+		container := &DumpedContainer{ID: id, State: *state, Interfaces: infos, CNIResults: map[string]json.RawMessage{}}
+		for ifname, result := range results {
+			if !json.Valid(result) {
+				return errors.Errorf("invalid CNI result of %s of container %s", ifname, id)
+			}
+			container.CNIResults[ifname] = result
+		}
+		dump.Containers = append(dump.Containers, container)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dump.Reservations, err = s.ListReservations(); err != nil {
+		return nil, err
+	}
+	if dump.Releases, err = s.ListReleases(); err != nil {
+		return nil, err
+	}
+	sort.Slice(dump.Reservations, func(i, j int) bool {
+		return dump.Reservations[i].Key < dump.Reservations[j].Key
+	})
+	sort.Slice(dump.Releases, func(i, j int) bool {
+		return dump.Releases[i].ContainerID < dump.Releases[j].ContainerID
+	})
+	return dump, nil
+}
+
+// Validate checks the dump is readable by this build.
+func (d *Dump) Validate() error {
+	if d.Version != DumpVersion {
+		return errors.Errorf("unsupported dump version %d, %d expected", d.Version, DumpVersion)
+	}
+	ids := map[string]struct{}{}
+	for _, container := range d.Containers {
+		if container.ID == "" {
+			return errors.New("container without ID")
+		}
+		if _, ok := ids[container.ID]; ok {
+			return errors.Errorf("duplicate container %s", container.ID)
+		}
+		ids[container.ID] = struct{}{}
+	}
+	for _, reservation := range d.Reservations {
+		if reservation.Key == "" || reservation.ContainerID == "" {
+			return errors.Errorf("incomplete reservation %+v", reservation)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpValidate(t *testing.T) {
+	valid := func() *Dump {
+		return &Dump{
+			Version:      DumpVersion,
+			Containers:   []*DumpedContainer{{ID: "c1"}, {ID: "c2"}},
+			Reservations: []*Reservation{{Key: "web", ContainerID: "c1"}},
+		}
+	}
+	assert.NoError(t, valid().Validate())
+
+	dump := valid()
+	dump.Version = DumpVersion + 1
+	assert.ErrorContains(t, dump.Validate(), "unsupported dump version")
+
+	dump = valid()
+	dump.Containers[1].ID = ""
+	assert.ErrorContains(t, dump.Validate(), "container without ID")
+
+	dump = valid()
+	dump.Containers[1].ID = "c1"
+	assert.ErrorContains(t, dump.Validate(), "duplicate container c1")
+
+	dump = valid()
+	dump.Reservations[0].ContainerID = ""
+	assert.ErrorContains(t, dump.Validate(), "incomplete reservation")
+
+	dump = valid()
+	dump.Reservations[0].Key = ""
+	assert.ErrorContains(t, dump.Validate(), "incomplete reservation")
+}
@@ -0,0 +1,530 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// key spaces under <etcd_prefix>/nodes/<node>/
+const (
+	stateDir       = "state"
+	interfaceDir   = "interfaces"
+	cniResultDir   = "results"
+	reservationDir = "reservations"
+	releaseDir     = "releases"
+	lockKey        = "lock"
+	heartbeatKey   = "heartbeat"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	lockTimeout    = 30 * time.Second // same as the file lock of the bbolt store
+	requestTimeout = 10 * time.Second
+	txnRetries     = 10
+)
+
+// Heartbeat is put under <etcd_prefix>/nodes/<node>/heartbeat with the lease
+// of the store, it's gone once the node closes the store or dies. Only the
+// daemon holds the store for long, so it tells the node is alive only while
+// the daemon runs: without it, the heartbeat comes and goes with each hook.
+type Heartbeat struct {
+	Node  string    `json:"node"`
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+// IPOwner is put under <etcd_prefix>/ips/<ip>/<node> for every IP recorded on
+// the node, so that the IPs taken across the cluster can be listed at once.
+type IPOwner struct {
+	Node        string `json:"node"`
+	ContainerID string `json:"container_id"`
+	IFName      string `json:"ifname"`
+}
+
+// Store keeps the records of this node in etcd. Like the bbolt store, Open
+// holds the lock of the node until Close, so the hooks of a node run one by
+// one, while the writes are guarded by the revisions of the keys they read
+// in case others, e.g. a scheduler, touch them.
+type Store struct {
+	conf    config.Config
+	node    string
+	client  *clientv3.Client
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+func New(conf config.Config) *Store {
+	node := conf.EtcdNodeName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	return &Store{
+		conf: conf,
+		node: node,
+	}
+}
+
+func (s *Store) Open() (err error) {
+	if s.client != nil {
+		return nil // Already opened
+	}
+	conf := &s.conf
+	var tlsConfig *tls.Config
+	if conf.EtcdCAFile != "" || conf.EtcdCertFile != "" {
+		tlsInfo := transport.TLSInfo{
+			TrustedCAFile: conf.EtcdCAFile,
+			CertFile:      conf.EtcdCertFile,
+			KeyFile:       conf.EtcdKeyFile,
+		}
+		if tlsConfig, err = tlsInfo.ClientConfig(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   conf.EtcdEndpoints,
+		DialTimeout: dialTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			client.Close()
+		}
+	}()
+
+	ttl := int(conf.EtcdLeaseTTL / time.Second)
+	if ttl <= 0 {
+		ttl = int(lockTimeout / time.Second)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	session, err := concurrency.NewSession(client, concurrency.WithTTL(ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to grant the lease")
+	}
+	defer func() {
+		if err != nil {
+			session.Close()
+		}
+	}()
+	mutex := concurrency.NewMutex(session, s.key(lockKey))
+	if err = mutex.Lock(ctx); err != nil {
+		return errors.Wrapf(err, "failed to lock node %s", s.node)
+	}
+
+	heartbeat, err := json.Marshal(Heartbeat{Node: s.node, PID: os.Getpid(), Since: time.Now()})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = client.Put(ctx, s.key(heartbeatKey), string(heartbeat), clientv3.WithLease(session.Lease())); err != nil {
+		return errors.WithStack(err)
+	}
+	s.client, s.session, s.mutex = client, session, mutex
+	return nil
+}
+
+// Close unlocks the node, the heartbeat goes away with the lease.
+func (s *Store) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := s.mutex.Unlock(ctx); err != nil {
+		log.Warnf("[store] failed to unlock node %s: %+v", s.node, err)
+	}
+	if err := s.session.Close(); err != nil {
+		log.Warnf("[store] failed to revoke the lease of node %s: %+v", s.node, err)
+	}
+	err := s.client.Close()
+	s.client, s.session, s.mutex = nil, nil, nil
+	return errors.WithStack(err)
+}
+
+// key is the path of the record under the node, the names are escaped.
+func (s *Store) key(dir string, names ...string) string {
+	parts := []string{strings.TrimSuffix(s.conf.EtcdPrefix, "/"), "nodes", url.PathEscape(s.node), dir}
+	for _, name := range names {
+		parts = append(parts, url.PathEscape(name))
+	}
+	return strings.Join(parts, "/")
+}
+
+// dir is the prefix of the keys under the directory of the node.
+func (s *Store) dir(dir string, names ...string) string {
+	return s.key(dir, names...) + "/"
+}
+
+func (s *Store) ipKey(ip string) string {
+	return strings.Join([]string{strings.TrimSuffix(s.conf.EtcdPrefix, "/"), "ips", url.PathEscape(ip), url.PathEscape(s.node)}, "/")
+}
+
+func (s *Store) get(key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, key, opts...)
+	return resp, errors.WithStack(err)
+}
+
+func (s *Store) put(key string, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err = s.client.Put(ctx, key, string(buf))
+	return errors.WithStack(err)
+}
+
+func (s *Store) delete(key string, opts ...clientv3.OpOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Delete(ctx, key, opts...)
+	return errors.WithStack(err)
+}
+
+// update reads keys and commits the ops returned by fn only if none of the
+// keys has changed in between, fn is retried with the new values otherwise.
+// The values of the absent keys are nil.
+func (s *Store) update(keys []string, fn func(values map[string][]byte) ([]clientv3.Op, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	for i := 0; i < txnRetries; i++ {
+		values := map[string][]byte{}
+		cmps := []clientv3.Cmp{}
+		for _, key := range keys {
+			resp, err := s.client.Get(ctx, key)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			var revision int64
+			if len(resp.Kvs) != 0 {
+				values[key], revision = resp.Kvs[0].Value, resp.Kvs[0].ModRevision
+			}
+			// the mod revision of an absent key is 0
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", revision))
+		}
+		ops, err := fn(values)
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		log.Debugf("[store] %v changed concurrently, retrying", keys)
+	}
+	return errors.Errorf("too many conflicts updating %v", keys)
+}
+
+func unmarshal(kv *mvccpb.KeyValue, v interface{}) error {
+	return errors.Wrapf(json.Unmarshal(kv.Value, v), "invalid record %s", kv.Key)
+}
+
+func decodeInterfaceInfos(data []byte) ([]*store.InterfaceInfo, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	infos := []*store.InterfaceInfo{}
+	return infos, errors.WithStack(json.Unmarshal(data, &infos))
+}
+
+// ipOps replaces the IP index entries of the old interfaces with the new ones.
+func (s *Store) ipOps(id string, olds, news []*store.InterfaceInfo) ([]clientv3.Op, error) {
+	ops := []clientv3.Op{}
+	kept := map[string]struct{}{}
+	for _, info := range news {
+		for _, ip := range info.IPs {
+			addr := ipOf(ip)
+			buf, err := json.Marshal(IPOwner{Node: s.node, ContainerID: id, IFName: info.IFName})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			ops = append(ops, clientv3.OpPut(s.ipKey(addr), string(buf)))
+			kept[addr] = struct{}{}
+		}
+	}
+	for _, info := range olds {
+		for _, ip := range info.IPs {
+			if _, ok := kept[ipOf(ip)]; !ok {
+				ops = append(ops, clientv3.OpDelete(s.ipKey(ipOf(ip))))
+				kept[ipOf(ip)] = struct{}{}
+			}
+		}
+	}
+	return ops, nil
+}
+
+// ipOf strips the prefix length of a CIDR.
+func ipOf(ip string) string {
+	return strings.SplitN(ip, "/", 2)[0]
+}
+
+func (s *Store) PutInterfaceInfo(key string, info *store.InterfaceInfo) error {
+	infoKey := s.key(interfaceDir, key)
+	return s.update([]string{infoKey}, func(values map[string][]byte) ([]clientv3.Op, error) {
+		olds, err := decodeInterfaceInfos(values[infoKey])
+		if err != nil {
+			return nil, err
+		}
+		infos := []*store.InterfaceInfo{}
+		replaced := false
+		for _, old := range olds {
+			if old.IFName == info.IFName {
+				old, replaced = info, true
+			}
+			infos = append(infos, old)
+		}
+		if !replaced {
+			infos = append(infos, info)
+		}
+		buf, err := json.Marshal(infos)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ops, err := s.ipOps(key, olds, infos)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, clientv3.OpPut(infoKey, string(buf))), nil
+	})
+}
+
+func (s *Store) GetInterfaceInfo(key string) (*store.InterfaceInfo, error) {
+	infos, err := s.ListInterfaceInfo(key)
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+func (s *Store) ListInterfaceInfo(key string) ([]*store.InterfaceInfo, error) {
+	resp, err := s.get(s.key(interfaceDir, key))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return decodeInterfaceInfos(resp.Kvs[0].Value)
+}
+
+func (s *Store) PutCNIResult(id, ifname string, result []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.Put(ctx, s.key(cniResultDir, id, ifname), string(result))
+	return errors.WithStack(err)
+}
+
+func (s *Store) GetCNIResult(id, ifname string) ([]byte, error) {
+	resp, err := s.get(s.key(cniResultDir, id, ifname))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (s *Store) DeleteCNIResults(id string) error {
+	return s.delete(s.dir(cniResultDir, id), clientv3.WithPrefix())
+}
+
+func (s *Store) ListCNIResults(id string) (map[string][]byte, error) {
+	dir := s.dir(cniResultDir, id)
+	resp, err := s.get(dir, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	results := map[string][]byte{}
+	for _, kv := range resp.Kvs {
+		ifname, err := url.PathUnescape(strings.TrimPrefix(string(kv.Key), dir))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		results[ifname] = kv.Value
+	}
+	return results, nil
+}
+
+func (s *Store) PutContainerState(id string, state *specs.State) error {
+	return s.put(s.key(stateDir, id), state)
+}
+
+func (s *Store) GetContainerState(id string) (*specs.State, error) {
+	resp, err := s.get(s.key(stateDir, id))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	state := &specs.State{}
+	return state, unmarshal(resp.Kvs[0], state)
+}
+
+func (s *Store) ListContainerStates() (map[string]specs.State, error) {
+	dir := s.dir(stateDir)
+	resp, err := s.get(dir, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]specs.State{}
+	for _, kv := range resp.Kvs {
+		id, err := url.PathUnescape(strings.TrimPrefix(string(kv.Key), dir))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var state specs.State
+		if err = unmarshal(kv, &state); err != nil {
+			return nil, err
+		}
+		states[id] = state
+	}
+	return states, nil
+}
+
+func (s *Store) ForEachContainer(fn func(id string, state *specs.State, infos []*store.InterfaceInfo) error) error {
+	type container struct {
+		id    string
+		state *specs.State
+		infos []*store.InterfaceInfo
+	}
+	stateDir, infoDir := s.dir(stateDir), s.dir(interfaceDir)
+	states, err := s.get(stateDir, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	// the interfaces of the same revision as the states
+	infos, err := s.get(infoDir, clientv3.WithPrefix(), clientv3.WithRev(states.Header.Revision))
+	if err != nil {
+		return err
+	}
+	infoValues := map[string][]byte{}
+	for _, kv := range infos.Kvs {
+		infoValues[strings.TrimPrefix(string(kv.Key), infoDir)] = kv.Value
+	}
+
+	containers := []container{}
+	for _, kv := range states.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), stateDir)
+		c := container{state: &specs.State{}}
+		if c.id, err = url.PathUnescape(name); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = unmarshal(kv, c.state); err != nil {
+			return err
+		}
+		if c.infos, err = decodeInterfaceInfos(infoValues[name]); err != nil {
+			return err
+		}
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].id < containers[j].id })
+	for _, c := range containers {
+		if err = fn(c.id, c.state, c.infos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteContainer(id string) error {
+	infoKey := s.key(interfaceDir, id)
+	return s.update([]string{infoKey}, func(values map[string][]byte) ([]clientv3.Op, error) {
+		infos, err := decodeInterfaceInfos(values[infoKey])
+		if err != nil {
+			return nil, err
+		}
+		ops, err := s.ipOps(id, infos, nil)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops,
+			clientv3.OpDelete(s.key(stateDir, id)),
+			clientv3.OpDelete(infoKey),
+			clientv3.OpDelete(s.key(releaseDir, id)),
+			clientv3.OpDelete(s.dir(cniResultDir, id), clientv3.WithPrefix()),
+		), nil
+	})
+}
+
+func (s *Store) PutReservation(reservation *store.Reservation) error {
+	return s.put(s.key(reservationDir, reservation.Key), reservation)
+}
+
+func (s *Store) GetReservation(key string) (*store.Reservation, error) {
+	resp, err := s.get(s.key(reservationDir, key))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	reservation := &store.Reservation{}
+	return reservation, unmarshal(resp.Kvs[0], reservation)
+}
+
+func (s *Store) ListReservations() ([]*store.Reservation, error) {
+	resp, err := s.get(s.dir(reservationDir), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	reservations := []*store.Reservation{}
+	for _, kv := range resp.Kvs {
+		reservation := &store.Reservation{}
+		if err = unmarshal(kv, reservation); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, nil
+}
+
+func (s *Store) DeleteReservation(key string) error {
+	return s.delete(s.key(reservationDir, key))
+}
+
+func (s *Store) PutRelease(release *store.Release) error {
+	return s.put(s.key(releaseDir, release.ContainerID), release)
+}
+
+func (s *Store) GetRelease(id string) (*store.Release, error) {
+	resp, err := s.get(s.key(releaseDir, id))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	release := &store.Release{}
+	return release, unmarshal(resp.Kvs[0], release)
+}
+
+func (s *Store) ListReleases() ([]*store.Release, error) {
+	resp, err := s.get(s.dir(releaseDir), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	releases := []*store.Release{}
+	for _, kv := range resp.Kvs {
+		release := &store.Release{}
+		if err = unmarshal(kv, release); err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+func (s *Store) DeleteRelease(id string) error {
+	return s.delete(s.key(releaseDir, id))
+}
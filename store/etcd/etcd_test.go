@@ -0,0 +1,241 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/projecteru2/docker-cni/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+var endpoint string
+
+// TestMain runs an embedded etcd shared by the tests, each test uses a node
+// of its own.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "etcd-test-*")
+	if err != nil {
+		panic(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		panic("etcd isn't ready")
+	}
+	endpoint = server.Clients[0].Addr().String()
+
+	code := m.Run()
+	server.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testConfig(t *testing.T) config.Config {
+	return config.Config{
+		EtcdEndpoints: []string{endpoint},
+		EtcdPrefix:    "/docker-cni/" + t.Name(),
+		EtcdNodeName:  t.Name(),
+		EtcdLeaseTTL:  5 * time.Second,
+	}
+}
+
+// setupTestStore opens a store under the prefix of the test, the keys left by
+// the former runs are wiped first.
+func setupTestStore(t *testing.T) *Store {
+	conf := testConfig(t)
+	client, err := clientv3.New(clientv3.Config{Endpoints: conf.EtcdEndpoints})
+	require.NoError(t, err)
+	_, err = client.Delete(context.Background(), conf.EtcdPrefix+"/", clientv3.WithPrefix())
+	client.Close()
+	require.NoError(t, err)
+
+	s := New(conf)
+	require.NoError(t, s.Open())
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestNew(t *testing.T) {
+	conf := testConfig(t)
+	s := New(conf)
+	assert.Equal(t, t.Name(), s.node)
+	assert.Nil(t, s.client)
+
+	conf.EtcdNodeName = ""
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, New(conf).node)
+}
+
+func TestOpenClose(t *testing.T) {
+	s := setupTestStore(t)
+	assert.NoError(t, s.Open(), "second open should not error")
+
+	resp, err := s.get(s.key(heartbeatKey))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	heartbeat := Heartbeat{}
+	require.NoError(t, json.Unmarshal(resp.Kvs[0].Value, &heartbeat))
+	assert.Equal(t, t.Name(), heartbeat.Node)
+	assert.Equal(t, os.Getpid(), heartbeat.PID)
+
+	// the lock of the node is held until close
+	other := New(testConfig(t))
+	done := make(chan error, 1)
+	go func() { done <- other.Open() }()
+	select {
+	case <-done:
+		t.Fatal("the node is opened twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, <-done)
+	defer other.Close()
+
+	assert.NoError(t, s.Close(), "second close should not error")
+
+	// the heartbeat of the closed one is revoked, the other one's is kept
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	require.NoError(t, err)
+	defer client.Close()
+	resp, err = client.Get(context.Background(), other.key(heartbeatKey))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, other.session.Lease(), clientv3.LeaseID(resp.Kvs[0].Lease))
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return setupTestStore(t)
+	})
+}
+
+func TestIPIndex(t *testing.T) {
+	s := setupTestStore(t)
+
+	eth0 := &store.InterfaceInfo{IFName: "eth0", IPs: []string{"10.0.0.2/32"}}
+	eth1 := &store.InterfaceInfo{IFName: "eth1", IPs: []string{"10.1.0.2/24"}}
+	require.NoError(t, s.PutInterfaceInfo("c1", eth0))
+	require.NoError(t, s.PutInterfaceInfo("c1", eth1))
+	require.NoError(t, s.PutInterfaceInfo("c2", &store.InterfaceInfo{IFName: "eth0", IPs: []string{"10.0.0.4/32"}}))
+
+	// the index follows the replaced interface
+	eth0.IPs = []string{"10.0.0.3/32"}
+	require.NoError(t, s.PutInterfaceInfo("c1", eth0))
+	assertIPs(t, s, map[string]IPOwner{
+		"10.0.0.3": {Node: t.Name(), ContainerID: "c1", IFName: "eth0"},
+		"10.1.0.2": {Node: t.Name(), ContainerID: "c1", IFName: "eth1"},
+		"10.0.0.4": {Node: t.Name(), ContainerID: "c2", IFName: "eth0"},
+	})
+
+	require.NoError(t, s.DeleteContainer("c1"))
+	assertIPs(t, s, map[string]IPOwner{"10.0.0.4": {Node: t.Name(), ContainerID: "c2", IFName: "eth0"}})
+
+	require.NoError(t, s.DeleteContainer("c2"))
+	assertIPs(t, s, map[string]IPOwner{})
+}
+
+// assertIPs checks the IP index entries of the node.
+func assertIPs(t *testing.T, s *Store, expected map[string]IPOwner) {
+	dir := s.conf.EtcdPrefix + "/ips/"
+	resp, err := s.get(dir, clientv3.WithPrefix())
+	require.NoError(t, err)
+	owners := map[string]IPOwner{}
+	for _, kv := range resp.Kvs {
+		ip, node, _ := strings.Cut(strings.TrimPrefix(string(kv.Key), dir), "/")
+		if node != url.PathEscape(s.node) {
+			continue
+		}
+		owner := IPOwner{}
+		require.NoError(t, json.Unmarshal(kv.Value, &owner))
+		owners[ip] = owner
+	}
+	assert.Equal(t, expected, owners)
+}
+
+func TestEscapedKeys(t *testing.T) {
+	s := setupTestStore(t)
+
+	// container10 shares the prefix of container1 but not the directory
+	require.NoError(t, s.PutCNIResult("container1", "eth0", []byte(`{}`)))
+	require.NoError(t, s.PutCNIResult("container10", "eth0", []byte(`{}`)))
+	require.NoError(t, s.DeleteCNIResults("container1"))
+	results, err := s.ListCNIResults("container10")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	// reservation keys are free text, e.g. IP_KEY
+	reservation := &store.Reservation{Key: "web/1", ContainerID: "c1", Holder: "c1"}
+	require.NoError(t, s.PutReservation(reservation))
+	got, err := s.GetReservation("web/1")
+	assert.NoError(t, err)
+	assert.Equal(t, reservation, got)
+	got, err = s.GetReservation("web")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestNodesAreIsolated(t *testing.T) {
+	s := setupTestStore(t)
+	conf := testConfig(t)
+	conf.EtcdNodeName = t.Name() + "-other"
+	other := New(conf)
+	require.NoError(t, other.Open())
+	defer other.Close()
+
+	require.NoError(t, s.PutContainerState("c1", &specs.State{ID: "c1"}))
+	require.NoError(t, s.PutReservation(&store.Reservation{Key: "web", ContainerID: "c1"}))
+	states, err := other.ListContainerStates()
+	assert.NoError(t, err)
+	assert.Empty(t, states)
+	reservation, err := other.GetReservation("web")
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+}
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	s := setupTestStore(t)
+	key := s.key(interfaceDir, "c1")
+
+	calls := 0
+	err := s.update([]string{key}, func(values map[string][]byte) ([]clientv3.Op, error) {
+		calls++
+		if calls == 1 {
+			// someone else writes between the read and the commit
+			_, err := s.client.Put(context.Background(), key, "[]")
+			require.NoError(t, err)
+			assert.Nil(t, values[key])
+		} else {
+			assert.Equal(t, "[]", string(values[key]))
+		}
+		return []clientv3.Op{clientv3.OpPut(key, `[{"ifname":"eth0","ips":null,"routes":null}]`)}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	infos, err := s.ListInterfaceInfo("c1")
+	assert.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "eth0", infos[0].IFName)
+}
@@ -0,0 +1,25 @@
+package factory
+
+import (
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/projecteru2/docker-cni/store/bbolt"
+	"github.com/projecteru2/docker-cni/store/etcd"
+	"github.com/projecteru2/docker-cni/store/jsonfile"
+)
+
+// NewStore picks the store by store_driver, see config.Config.Validate for
+// the required settings.
+func NewStore(conf config.Config) (store.Store, error) {
+	switch conf.StoreDriver {
+	case "bbolt", "":
+		return bbolt.New(conf), nil
+	case "json":
+		return jsonfile.New(conf), nil
+	case "etcd":
+		return etcd.New(conf), nil
+	default:
+		return nil, errors.Errorf("unknown store_driver %q", conf.StoreDriver)
+	}
+}
@@ -0,0 +1,426 @@
+package jsonfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+)
+
+// directories and files under store_dir
+const (
+	containerDir   = "containers"
+	reservationDir = "reservations"
+	lockFile       = "lock"
+	fileSuffix     = ".json"
+	tempSuffix     = ".tmp" // files being written
+)
+
+const (
+	lockTimeout  = 30 * time.Second // same as the file lock of the bbolt store
+	lockInterval = 50 * time.Millisecond
+)
+
+// container is everything stored under a container ID, kept in one file.
+type container struct {
+	ID         string                     `json:"id"`
+	State      *specs.State               `json:"state,omitempty"`
+	Interfaces []*store.InterfaceInfo     `json:"interfaces,omitempty"`
+	CNIResults map[string]json.RawMessage `json:"cni_results,omitempty"`
+	Release    *store.Release             `json:"release,omitempty"`
+}
+
+func (c *container) empty() bool {
+	return c.State == nil && len(c.Interfaces) == 0 && len(c.CNIResults) == 0 && c.Release == nil
+}
+
+// Store keeps the records as plain JSON files under store_dir, one per
+// container and one per reservation. The files are replaced by renames, and
+// Open holds a flock of store_dir until Close, as the bbolt store does.
+type Store struct {
+	conf config.Config
+	lock *os.File
+}
+
+func New(conf config.Config) *Store {
+	return &Store{
+		conf: conf,
+	}
+}
+
+func (s *Store) Open() error {
+	if s.lock != nil {
+		return nil // Already opened
+	}
+	for _, dir := range []string{containerDir, reservationDir} {
+		if err := os.MkdirAll(filepath.Join(s.conf.StoreDir, dir), 0700); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(s.conf.StoreDir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(lockInterval)
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to lock %s", s.conf.StoreDir)
+	}
+	s.lock = f
+	return nil
+}
+
+// Close releases the flock along with the file.
+func (s *Store) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return errors.WithStack(err)
+}
+
+func (s *Store) path(dir, name string) string {
+	return filepath.Join(s.conf.StoreDir, dir, url.PathEscape(name)+fileSuffix)
+}
+
+// read decodes the file into v, found is false if it doesn't exist.
+func read(path string, v interface{}) (found bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, errors.Wrapf(json.Unmarshal(data, v), "invalid record %s", path)
+}
+
+// write replaces the file with v atomically: a crash leaves either the old
+// content or the new one.
+func write(path string, v interface{}) (err error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return errors.WithStack(err)
+	}
+	// persist the rename
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer d.Close()
+	return errors.WithStack(d.Sync())
+}
+
+func remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// list returns the files under the dir, the temporary ones are skipped.
+func (s *Store) list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.conf.StoreDir, dir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	paths := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, tempSuffix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		paths = append(paths, filepath.Join(s.conf.StoreDir, dir, name))
+	}
+	return paths, nil
+}
+
+func (s *Store) getContainer(id string) (*container, error) {
+	c := &container{}
+	found, err := read(s.path(containerDir, id), c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &container{ID: id}, nil
+	}
+	return c, nil
+}
+
+// listContainers returns all the containers in the order of IDs.
+func (s *Store) listContainers() ([]*container, error) {
+	paths, err := s.list(containerDir)
+	if err != nil {
+		return nil, err
+	}
+	containers := []*container{}
+	for _, path := range paths {
+		c := &container{}
+		if _, err = read(path, c); err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers, nil
+}
+
+// updateContainer writes the container back after fn, the file is removed
+// once nothing is left in it.
+func (s *Store) updateContainer(id string, fn func(c *container) error) error {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if err = fn(c); err != nil {
+		return err
+	}
+	if c.empty() {
+		return remove(s.path(containerDir, id))
+	}
+	return write(s.path(containerDir, id), c)
+}
+
+func (s *Store) PutInterfaceInfo(key string, info *store.InterfaceInfo) error {
+	return s.updateContainer(key, func(c *container) error {
+		for i, old := range c.Interfaces {
+			if old.IFName == info.IFName {
+				c.Interfaces[i] = info
+				return nil
+			}
+		}
+		c.Interfaces = append(c.Interfaces, info)
+		return nil
+	})
+}
+
+func (s *Store) GetInterfaceInfo(key string) (*store.InterfaceInfo, error) {
+	infos, err := s.ListInterfaceInfo(key)
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+func (s *Store) ListInterfaceInfo(key string) ([]*store.InterfaceInfo, error) {
+	c, err := s.getContainer(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Interfaces, nil
+}
+
+// PutCNIResult keeps the result as a JSON value of the file, it's compacted
+// when read back.
+func (s *Store) PutCNIResult(id, ifname string, result []byte) error {
+	if !json.Valid(result) {
+		return errors.Errorf("invalid CNI result of %s of container %s", ifname, id)
+	}
+	return s.updateContainer(id, func(c *container) error {
+		if c.CNIResults == nil {
+			c.CNIResults = map[string]json.RawMessage{}
+		}
+		c.CNIResults[ifname] = result
+		return nil
+	})
+}
+
+func (s *Store) GetCNIResult(id, ifname string) ([]byte, error) {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := c.CNIResults[ifname]
+	if !ok {
+		return nil, nil
+	}
+	return compact(result)
+}
+
+func compact(result []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, result); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Store) DeleteCNIResults(id string) error {
+	return s.updateContainer(id, func(c *container) error {
+		c.CNIResults = nil
+		return nil
+	})
+}
+
+func (s *Store) ListCNIResults(id string) (map[string][]byte, error) {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	results := map[string][]byte{}
+	for ifname, result := range c.CNIResults {
+		if results[ifname], err = compact(result); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (s *Store) PutContainerState(id string, state *specs.State) error {
+	return s.updateContainer(id, func(c *container) error {
+		c.State = state
+		return nil
+	})
+}
+
+func (s *Store) GetContainerState(id string) (*specs.State, error) {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.State, nil
+}
+
+func (s *Store) ListContainerStates() (map[string]specs.State, error) {
+	containers, err := s.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]specs.State)
+	for _, c := range containers {
+		if c.State != nil {
+			states[c.ID] = *c.State
+		}
+	}
+	return states, nil
+}
+
+func (s *Store) ForEachContainer(fn func(id string, state *specs.State, infos []*store.InterfaceInfo) error) error {
+	containers, err := s.listContainers()
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if c.State == nil {
+			continue
+		}
+		if err = fn(c.ID, c.State, c.Interfaces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteContainer(id string) error {
+	return remove(s.path(containerDir, id))
+}
+
+func (s *Store) PutRelease(release *store.Release) error {
+	return s.updateContainer(release.ContainerID, func(c *container) error {
+		c.Release = release
+		return nil
+	})
+}
+
+func (s *Store) GetRelease(id string) (*store.Release, error) {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Release, nil
+}
+
+func (s *Store) ListReleases() ([]*store.Release, error) {
+	containers, err := s.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	releases := []*store.Release{}
+	for _, c := range containers {
+		if c.Release != nil {
+			releases = append(releases, c.Release)
+		}
+	}
+	return releases, nil
+}
+
+func (s *Store) DeleteRelease(id string) error {
+	return s.updateContainer(id, func(c *container) error {
+		c.Release = nil
+		return nil
+	})
+}
+
+func (s *Store) PutReservation(reservation *store.Reservation) error {
+	return write(s.path(reservationDir, reservation.Key), reservation)
+}
+
+func (s *Store) GetReservation(key string) (*store.Reservation, error) {
+	reservation := &store.Reservation{}
+	found, err := read(s.path(reservationDir, key), reservation)
+	if err != nil || !found {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (s *Store) ListReservations() ([]*store.Reservation, error) {
+	paths, err := s.list(reservationDir)
+	if err != nil {
+		return nil, err
+	}
+	reservations := []*store.Reservation{}
+	for _, path := range paths {
+		reservation := &store.Reservation{}
+		if _, err = read(path, reservation); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+	return reservations, nil
+}
+
+func (s *Store) DeleteReservation(key string) error {
+	return remove(s.path(reservationDir, key))
+}
@@ -0,0 +1,98 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/config"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/projecteru2/docker-cni/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestStore(t *testing.T) *Store {
+	s := New(config.Config{StoreDir: filepath.Join(t.TempDir(), "store")})
+	require.NoError(t, s.Open())
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return setupTestStore(t)
+	})
+}
+
+func TestOpenClose(t *testing.T) {
+	s := setupTestStore(t)
+	assert.NoError(t, s.Open(), "second open should not error")
+
+	// the store dir is locked until close
+	other := New(s.conf)
+	done := make(chan error, 1)
+	go func() { done <- other.Open() }()
+	select {
+	case <-done:
+		t.Fatal("the store is opened twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, <-done)
+	assert.NoError(t, other.Close())
+	assert.NoError(t, s.Close(), "second close should not error")
+}
+
+func TestFiles(t *testing.T) {
+	s := setupTestStore(t)
+
+	require.NoError(t, s.PutContainerState("container1", &specs.State{ID: "container1", Status: "running"}))
+	require.NoError(t, s.PutInterfaceInfo("container1", &store.InterfaceInfo{IFName: "eth0", IPs: []string{"10.0.0.2/24"}}))
+	require.NoError(t, s.PutCNIResult("container1", "eth0", []byte(`{"cniVersion": "1.0.0"}`)))
+	require.NoError(t, s.PutReservation(&store.Reservation{Key: "web/1", ContainerID: "container1", Holder: "container1"}))
+
+	// one readable file per container, no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(s.conf.StoreDir, containerDir))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err := os.ReadFile(filepath.Join(s.conf.StoreDir, containerDir, "container1.json"))
+	require.NoError(t, err)
+	c := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal(data, &c))
+	assert.Contains(t, c, "state")
+	assert.Contains(t, c, "interfaces")
+	assert.Contains(t, c, "cni_results")
+
+	// the results are valid JSON, read back compacted
+	assert.Error(t, s.PutCNIResult("container1", "eth1", []byte("not json")))
+	result, err := s.GetCNIResult("container1", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"cniVersion":"1.0.0"}`, string(result))
+
+	// keys are escaped into file names
+	entries, err = os.ReadDir(filepath.Join(s.conf.StoreDir, reservationDir))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "web%2F1.json", entries[0].Name())
+	reservation, err := s.GetReservation("web/1")
+	assert.NoError(t, err)
+	require.NotNil(t, reservation)
+
+	// names starting with "." are listed, the temporary files are not
+	require.NoError(t, s.PutReservation(&store.Reservation{Key: ".web", ContainerID: "container1", Holder: "container1"}))
+	require.NoError(t, os.WriteFile(filepath.Join(s.conf.StoreDir, reservationDir, "web.json.123"+tempSuffix), []byte("{"), 0600))
+	reservations, err := s.ListReservations()
+	assert.NoError(t, err)
+	require.Len(t, reservations, 2)
+	assert.Equal(t, ".web", reservations[0].Key)
+
+	// the file goes away with the last record
+	require.NoError(t, s.DeleteContainer("container1"))
+	entries, err = os.ReadDir(filepath.Join(s.conf.StoreDir, containerDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
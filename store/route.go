@@ -0,0 +1,81 @@
+package store
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const scopeLink = 253
+
+// Route is a route through the container interface, as captured by netlink.
+type Route struct {
+	Dst      string `json:"dst"`          // in CIDR notation, 0.0.0.0/0 or ::/0 for default route
+	Gw       string `json:"gw,omitempty"` // empty for directly connected routes
+	Scope    int    `json:"scope"`
+	Table    int    `json:"table,omitempty"`
+	Metric   int    `json:"metric,omitempty"`
+	Protocol int    `json:"protocol,omitempty"`
+	Src      string `json:"src,omitempty"`
+	MTU      int    `json:"mtu,omitempty"`
+	OnLink   bool   `json:"onlink,omitempty"`
+}
+
+// UnmarshalJSON also accepts the legacy "dst=... via=..." strings.
+func (r *Route) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		route, err := parseLegacyRoute(legacy)
+		if err != nil {
+			return err
+		}
+		*r = *route
+		return nil
+	}
+	type plain Route
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+func parseLegacyRoute(s string) (*Route, error) {
+	route := &Route{Scope: -1}
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid route %q", s)
+		}
+		var err error
+		switch kv[0] {
+		case "dst":
+			route.Dst = kv[1]
+		case "via":
+			route.Gw = kv[1]
+		case "scope":
+			route.Scope, err = strconv.Atoi(kv[1])
+		case "table":
+			route.Table, err = strconv.Atoi(kv[1])
+		case "metric":
+			route.Metric, err = strconv.Atoi(kv[1])
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid route %q", s)
+		}
+	}
+
+	if route.Dst == "default" {
+		route.Dst = "0.0.0.0/0"
+		if ip := net.ParseIP(route.Gw); ip != nil && ip.To4() == nil {
+			route.Dst = "::/0"
+		}
+	}
+	if route.Scope == -1 {
+		// scope wasn't recorded, guess it the same way as iproute2
+		route.Scope = 0
+		if route.Gw == "" {
+			route.Scope = scopeLink
+		}
+	}
+	return route, nil
+}
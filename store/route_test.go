@@ -0,0 +1,70 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteRoundTrip(t *testing.T) {
+	routes := []Route{
+		{Dst: "0.0.0.0/0", Gw: "169.254.1.1", Scope: 0, OnLink: true},
+		{Dst: "169.254.1.1/32", Scope: scopeLink},
+		{Dst: "10.0.0.0/8", Gw: "10.0.0.1", Table: 100, Metric: 10, Protocol: 4, Src: "10.0.0.2", MTU: 1400},
+	}
+	data, err := json.Marshal(routes)
+	require.NoError(t, err)
+	decoded := []Route{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, routes, decoded)
+}
+
+func TestRouteLegacy(t *testing.T) {
+	cases := []struct {
+		legacy   string
+		expected Route
+	}{
+		{"dst=default via=169.254.1.1", Route{Dst: "0.0.0.0/0", Gw: "169.254.1.1", Scope: 0}},
+		{"dst=169.254.1.1/32 via=", Route{Dst: "169.254.1.1/32", Scope: scopeLink}},
+		{"dst=default via=fe80::1", Route{Dst: "::/0", Gw: "fe80::1", Scope: 0}},
+		{"dst=10.0.0.0/8 via=10.0.0.1 scope=0 table=100 metric=10", Route{Dst: "10.0.0.0/8", Gw: "10.0.0.1", Table: 100, Metric: 10}},
+		{"dst=10.0.0.0/24 via= scope=0", Route{Dst: "10.0.0.0/24", Scope: 0}},
+		// unknown fields are ignored
+		{"dst=10.0.0.0/24 via= proto=kernel", Route{Dst: "10.0.0.0/24", Scope: scopeLink}},
+	}
+	for _, c := range cases {
+		data, err := json.Marshal(c.legacy)
+		require.NoError(t, err)
+		route := Route{}
+		if assert.NoError(t, json.Unmarshal(data, &route), c.legacy) {
+			assert.Equal(t, c.expected, route, c.legacy)
+		}
+	}
+
+	for _, legacy := range []string{"dst", "dst=10.0.0.0/24 scope=link", "dst=10.0.0.0/24 metric=high"} {
+		data, err := json.Marshal(legacy)
+		require.NoError(t, err)
+		assert.ErrorContains(t, json.Unmarshal(data, &Route{}), "invalid route", legacy)
+	}
+}
+
+func TestInterfaceInfoLegacyRoutes(t *testing.T) {
+	// as stored by the former versions
+	data := `{"ifname":"eth0","ips":["10.0.0.2/32"],"routes":["dst=169.254.1.1/32 via=","dst=default via=169.254.1.1"]}`
+	info := InterfaceInfo{}
+	require.NoError(t, json.Unmarshal([]byte(data), &info))
+	assert.Equal(t, []Route{
+		{Dst: "169.254.1.1/32", Scope: scopeLink},
+		{Dst: "0.0.0.0/0", Gw: "169.254.1.1"},
+	}, info.Routes)
+
+	// written back in the current format
+	data2, err := json.Marshal(info)
+	require.NoError(t, err)
+	decoded := InterfaceInfo{}
+	require.NoError(t, json.Unmarshal(data2, &decoded))
+	assert.Equal(t, info, decoded)
+	assert.NotContains(t, string(data2), "dst=")
+}
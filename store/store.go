@@ -1,25 +1,110 @@
 package store
 
 import (
+	"time"
+
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 type InterfaceInfo struct {
-	IFName     string   `json:"ifname"`                // interface name in container netns
-	HostIFName string   `json:"host_ifname,omitempty"` // host side veth name
-	MAC        string   `json:"mac,omitempty"`         // MAC address of the container interface
-	IPs        []string `json:"ips"`
-	Routes     []string `json:"routes"`
+	Network    string     `json:"network,omitempty"`     // name of the CNI network, empty for the default one
+	Type       string     `json:"type,omitempty"`        // network type used to restore the interface, cni_type if empty
+	IFName     string     `json:"ifname"`                // interface name in container netns
+	HostIFName string     `json:"host_ifname,omitempty"` // host side veth name
+	MAC        string     `json:"mac,omitempty"`         // MAC address of the container interface
+	LinkType   string     `json:"link_type,omitempty"`   // netlink type of the container interface, e.g. veth
+	MTU        int        `json:"mtu,omitempty"`
+	IPs        []string   `json:"ips"`
+	Routes     []Route    `json:"routes"`
+	Neighbors  []Neighbor `json:"neighbors,omitempty"` // static neighbor entries in container netns
+
+	PortMappings []PortMapping `json:"port_mappings,omitempty"` // published by portmap plugin
+
+	BootID  string    `json:"boot_id,omitempty"`  // host boot the interface was plumbed in, see /proc/sys/kernel/random/boot_id
+	AddedAt time.Time `json:"added_at,omitempty"` // last time the interface was added or restored
+	Drift   string    `json:"drift,omitempty"`    // how the container netns differs from the record, found by reconcile
+
+	// bridge plugin only
+	Bridge      string `json:"bridge,omitempty"` // bridge the host veth is enslaved to
+	VLAN        int    `json:"vlan,omitempty"`   // PVID of the host veth on the bridge
+	HairpinMode bool   `json:"hairpin_mode,omitempty"`
+	PromiscMode bool   `json:"promisc_mode,omitempty"` // promiscuous mode of the bridge
+
+	// macvlan and ipvlan plugins only
+	Parent string `json:"parent,omitempty"` // master interface in host netns
+	Mode   string `json:"mode,omitempty"`   // bridge/private/vepa/passthru for macvlan, l2/l3/l3s for ipvlan
+}
+
+type Neighbor struct {
+	IP    string `json:"ip"`
+	MAC   string `json:"mac"`
+	State int    `json:"state"` // NUD_* flags
+}
+
+// PortMapping is in the same JSON shape as the portMappings capability.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// Reservation hands the network of a removed container over to the next one
+// with the same key, e.g. the container name.
+type Reservation struct {
+	Key         string    `json:"key"`
+	ContainerID string    `json:"container_id"`          // the records and the CNI resources are under this ID
+	Holder      string    `json:"holder"`                // container using the network now
+	ReleasedAt  time.Time `json:"released_at,omitempty"` // when the holder was found removed, zero if it's alive
+}
+
+// Release tracks the CNI DEL of a removed container, the records of the
+// container are kept until DEL succeeds.
+type Release struct {
+	ContainerID string    `json:"container_id"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"` // backoff after failures
 }
 
 type Store interface {
 	Open() error
 	Close() error
+	// a container has one InterfaceInfo per attached network, PutInterfaceInfo
+	// replaces the one with the same IFName or appends a new one.
 	PutInterfaceInfo(key string, info *InterfaceInfo) error
+	// GetInterfaceInfo returns the first attached interface
 	GetInterfaceInfo(key string) (*InterfaceInfo, error)
+	// ListInterfaceInfo returns all interfaces in the order they were attached
+	ListInterfaceInfo(key string) ([]*InterfaceInfo, error)
+
+	// CNI results are the raw versioned results of ADD, per container and interface
+	PutCNIResult(id, ifname string, result []byte) error
+	GetCNIResult(id, ifname string) ([]byte, error)
+	DeleteCNIResults(id string) error
+	// ListCNIResults returns the results of the container by interface name
+	ListCNIResults(id string) (map[string][]byte, error)
 
 	PutContainerState(id string, state *specs.State) error
 	GetContainerState(id string) (*specs.State, error)
+	ListContainerStates() (map[string]specs.State, error)
+	// ForEachContainer calls fn with the state and interfaces of every container
+	// in the order of IDs, fn may use the store, the iteration stops if it fails.
+	ForEachContainer(fn func(id string, state *specs.State, infos []*InterfaceInfo) error) error
+
+	// DeleteContainer drops all the records of the container, including its release
+	DeleteContainer(id string) error
+
+	// releases are indexed by container ID
+	PutRelease(release *Release) error
+	GetRelease(id string) (*Release, error)
+	ListReleases() ([]*Release, error)
+	DeleteRelease(id string) error
 
-	DeleteContiners(existContainerIDs map[string]struct{}) (map[string]specs.State, error)
+	// reservations are indexed by key
+	PutReservation(reservation *Reservation) error
+	GetReservation(key string) (*Reservation, error)
+	ListReservations() ([]*Reservation, error)
+	DeleteReservation(key string) error
 }
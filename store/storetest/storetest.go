@@ -0,0 +1,316 @@
+// Package storetest is the conformance tests of store.Store, run by the tests
+// of every backend.
+package storetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/projecteru2/docker-cni/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance tests, newStore returns an empty opened store and
+// closes it when the test is done, e.g. with t.Cleanup.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	t.Run("ContainerState", func(t *testing.T) { testContainerState(t, newStore(t)) })
+	t.Run("InterfaceInfo", func(t *testing.T) { testInterfaceInfo(t, newStore(t)) })
+	t.Run("MultipleInterfaceInfo", func(t *testing.T) { testMultipleInterfaceInfo(t, newStore(t)) })
+	t.Run("CNIResult", func(t *testing.T) { testCNIResult(t, newStore(t)) })
+	t.Run("ListCNIResults", func(t *testing.T) { testListCNIResults(t, newStore(t)) })
+	t.Run("Reservation", func(t *testing.T) { testReservation(t, newStore(t)) })
+	t.Run("Release", func(t *testing.T) { testRelease(t, newStore(t)) })
+	t.Run("DeleteContainer", func(t *testing.T) { testDeleteContainer(t, newStore(t)) })
+	t.Run("ForEachContainer", func(t *testing.T) { testForEachContainer(t, newStore(t)) })
+}
+
+func testContainerState(t *testing.T, s store.Store) {
+	testState := &specs.State{
+		Version: "1.0.0",
+		ID:      "container1",
+		Status:  "running",
+		Pid:     1234,
+		Bundle:  "/path/to/bundle",
+	}
+
+	// Test PutContainerState
+	err := s.PutContainerState(testState.ID, testState)
+	assert.NoError(t, err)
+
+	// Test GetContainerState
+	retrieved, err := s.GetContainerState(testState.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, testState.Version, retrieved.Version)
+	assert.Equal(t, testState.ID, retrieved.ID)
+	assert.Equal(t, testState.Status, retrieved.Status)
+	assert.Equal(t, testState.Pid, retrieved.Pid)
+	assert.Equal(t, testState.Bundle, retrieved.Bundle)
+
+	// Test getting non-existent container
+	retrieved, err = s.GetContainerState("non-existent")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	// Test updating existing container
+	testState.Status = "stopped"
+	err = s.PutContainerState(testState.ID, testState)
+	assert.NoError(t, err)
+
+	retrieved, err = s.GetContainerState(testState.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "stopped", retrieved.Status)
+
+	// Test listing containers
+	states, err := s.ListContainerStates()
+	assert.NoError(t, err)
+	assert.Len(t, states, 1)
+	assert.Equal(t, *testState, states[testState.ID])
+}
+
+func testInterfaceInfo(t *testing.T, s store.Store) {
+	testInfo := &store.InterfaceInfo{
+		IFName:     "eth0",
+		HostIFName: "veth123",
+		IPs:        []string{"10.0.0.2/24", "fd00::2/64"},
+		Routes:     []store.Route{{Dst: "0.0.0.0/0", Gw: "10.0.0.1", Table: 254}},
+	}
+
+	// Test PutInterfaceInfo
+	err := s.PutInterfaceInfo("container1", testInfo)
+	assert.NoError(t, err)
+
+	// Test GetInterfaceInfo
+	retrieved, err := s.GetInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.NotNil(t, retrieved)
+	assert.Equal(t, testInfo.IFName, retrieved.IFName)
+	assert.Equal(t, testInfo.HostIFName, retrieved.HostIFName)
+	assert.Equal(t, testInfo.IPs, retrieved.IPs)
+	assert.Equal(t, testInfo.Routes, retrieved.Routes)
+
+	// Test getting non-existent interface
+	retrieved, err = s.GetInterfaceInfo("non-existent")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	// Test updating existing interface info
+	testInfo.IPs = []string{"10.0.0.3/24"}
+	err = s.PutInterfaceInfo("container1", testInfo)
+	assert.NoError(t, err)
+
+	retrieved, err = s.GetInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3/24"}, retrieved.IPs)
+}
+
+func testMultipleInterfaceInfo(t *testing.T, s store.Store) {
+	eth0 := &store.InterfaceInfo{IFName: "eth0", IPs: []string{"10.0.0.2/24"}}
+	net1 := &store.InterfaceInfo{Network: "storage", IFName: "net1", IPs: []string{"192.168.0.2/24"}}
+	require.NoError(t, s.PutInterfaceInfo("container1", eth0))
+	require.NoError(t, s.PutInterfaceInfo("container1", net1))
+
+	infos, err := s.ListInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.Equal(t, []*store.InterfaceInfo{eth0, net1}, infos)
+
+	// Test replacing keeps the order
+	eth0.IPs = []string{"10.0.0.3/24"}
+	require.NoError(t, s.PutInterfaceInfo("container1", eth0))
+	infos, err = s.ListInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.Equal(t, []*store.InterfaceInfo{eth0, net1}, infos)
+
+	// Test the first one is the primary interface
+	retrieved, err := s.GetInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.Equal(t, eth0, retrieved)
+
+	infos, err = s.ListInterfaceInfo("non-existent")
+	assert.NoError(t, err)
+	assert.Empty(t, infos)
+}
+
+func testCNIResult(t *testing.T, s store.Store) {
+	result := []byte(`{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.2/24"}]}`)
+	err := s.PutCNIResult("container1", "eth0", result)
+	assert.NoError(t, err)
+
+	retrieved, err := s.GetCNIResult("container1", "eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, result, retrieved)
+
+	// Test getting non-existent results
+	retrieved, err = s.GetCNIResult("container1", "eth1")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+	retrieved, err = s.GetCNIResult("non-existent", "eth0")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+
+	// Test deleting results, twice
+	assert.NoError(t, s.DeleteCNIResults("container1"))
+	assert.NoError(t, s.DeleteCNIResults("container1"))
+	retrieved, err = s.GetCNIResult("container1", "eth0")
+	assert.NoError(t, err)
+	assert.Nil(t, retrieved)
+}
+
+func testListCNIResults(t *testing.T, s store.Store) {
+	results, err := s.ListCNIResults("container1")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	result0 := []byte(`{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.2/24"}]}`)
+	result1 := []byte(`{"cniVersion":"1.0.0","ips":[{"address":"10.1.0.2/24"}]}`)
+	require.NoError(t, s.PutCNIResult("container1", "eth0", result0))
+	require.NoError(t, s.PutCNIResult("container1", "net1", result1))
+	require.NoError(t, s.PutCNIResult("container2", "eth0", result1))
+
+	results, err = s.ListCNIResults("container1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"eth0": result0, "net1": result1}, results)
+}
+
+func testReservation(t *testing.T, s store.Store) {
+	reservation, err := s.GetReservation("web")
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+
+	reservations, err := s.ListReservations()
+	assert.NoError(t, err)
+	assert.Empty(t, reservations)
+
+	testReservation := &store.Reservation{
+		Key:         "web",
+		ContainerID: "container1",
+		Holder:      "container2",
+		ReleasedAt:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, s.PutReservation(testReservation))
+	require.NoError(t, s.PutReservation(&store.Reservation{Key: "db", ContainerID: "container3", Holder: "container3"}))
+
+	reservation, err = s.GetReservation("web")
+	assert.NoError(t, err)
+	require.NotNil(t, reservation)
+	assert.Equal(t, testReservation.ContainerID, reservation.ContainerID)
+	assert.Equal(t, testReservation.Holder, reservation.Holder)
+	assert.True(t, testReservation.ReleasedAt.Equal(reservation.ReleasedAt))
+
+	reservations, err = s.ListReservations()
+	assert.NoError(t, err)
+	assert.Len(t, reservations, 2)
+
+	require.NoError(t, s.DeleteReservation("web"))
+	reservation, err = s.GetReservation("web")
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+}
+
+func testRelease(t *testing.T, s store.Store) {
+	release, err := s.GetRelease("container1")
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+
+	testRelease := &store.Release{
+		ContainerID: "container1",
+		Attempts:    2,
+		LastError:   "plugin failed",
+		LastAttempt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NextAttempt: time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC),
+	}
+	require.NoError(t, s.PutRelease(testRelease))
+
+	release, err = s.GetRelease("container1")
+	assert.NoError(t, err)
+	require.NotNil(t, release)
+	assert.Equal(t, testRelease.Attempts, release.Attempts)
+	assert.Equal(t, testRelease.LastError, release.LastError)
+	assert.True(t, testRelease.NextAttempt.Equal(release.NextAttempt))
+
+	releases, err := s.ListReleases()
+	assert.NoError(t, err)
+	assert.Len(t, releases, 1)
+
+	require.NoError(t, s.DeleteRelease("container1"))
+	release, err = s.GetRelease("container1")
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+}
+
+func testDeleteContainer(t *testing.T, s store.Store) {
+	for _, id := range []string{"container1", "container2"} {
+		require.NoError(t, s.PutContainerState(id, &specs.State{ID: id}))
+		require.NoError(t, s.PutInterfaceInfo(id, &store.InterfaceInfo{IFName: "eth0"}))
+		require.NoError(t, s.PutCNIResult(id, "eth0", []byte(`{"cniVersion":"1.0.0"}`)))
+		require.NoError(t, s.PutRelease(&store.Release{ContainerID: id}))
+	}
+
+	require.NoError(t, s.DeleteContainer("container1"))
+	// deleting twice is fine
+	require.NoError(t, s.DeleteContainer("container1"))
+
+	state, err := s.GetContainerState("container1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+	info, err := s.GetInterfaceInfo("container1")
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+	result, err := s.GetCNIResult("container1", "eth0")
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+	release, err := s.GetRelease("container1")
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+
+	state, err = s.GetContainerState("container2")
+	assert.NoError(t, err)
+	assert.NotNil(t, state)
+	release, err = s.GetRelease("container2")
+	assert.NoError(t, err)
+	assert.NotNil(t, release)
+}
+
+func testForEachContainer(t *testing.T, s store.Store) {
+	// nothing stored yet
+	called := false
+	assert.NoError(t, s.ForEachContainer(func(string, *specs.State, []*store.InterfaceInfo) error {
+		called = true
+		return nil
+	}))
+	assert.False(t, called)
+
+	require.NoError(t, s.PutContainerState("container2", &specs.State{ID: "container2", Status: "stopped"}))
+	require.NoError(t, s.PutContainerState("container1", &specs.State{ID: "container1", Status: "running"}))
+	require.NoError(t, s.PutInterfaceInfo("container1", &store.InterfaceInfo{IFName: "eth0"}))
+	require.NoError(t, s.PutInterfaceInfo("container1", &store.InterfaceInfo{IFName: "net1"}))
+
+	ids := []string{}
+	err := s.ForEachContainer(func(id string, state *specs.State, infos []*store.InterfaceInfo) error {
+		ids = append(ids, id)
+		assert.Equal(t, id, state.ID)
+		switch id {
+		case "container1":
+			assert.Equal(t, "running", state.Status)
+			require.Len(t, infos, 2)
+			assert.Equal(t, "net1", infos[1].IFName)
+		case "container2":
+			assert.Empty(t, infos)
+		}
+		// the store is usable within fn
+		return s.PutRelease(&store.Release{ContainerID: id})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"container1", "container2"}, ids)
+
+	// stops at the first error
+	ids = []string{}
+	err = s.ForEachContainer(func(id string, _ *specs.State, _ []*store.InterfaceInfo) error {
+		ids = append(ids, id)
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, []string{"container1"}, ids)
+}